@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Job is one conversion described in a project file:
+//
+//	jobs = {
+//		{
+//			name = "items",
+//			input = {"design/items/**/*.xlsx"},
+//			sheet = "Sheet1",
+//			key = "ID",
+//			output = {
+//				{type = "lua", dir = "out/client", side = "client"},
+//				{type = "json", dir = "out/server", side = "server"},
+//			},
+//		},
+//	}
+type Job struct {
+	Name   string
+	Input  []string
+	Sheet  string
+	Key    string
+	Output []JobOutput
+	Force  bool
+
+	ConstraintRow int
+	Enums         []string
+	IDRange       string
+
+	HeaderRow     int
+	TypeRow       int
+	DescRow       int
+	DataRow       int
+	CommentPrefix string
+	FillMerged    bool
+	SkipHidden    []string
+	Formula       string
+
+	CsvSep        string
+	CsvComment    string
+	CsvEncoding   string
+	CsvLazyQuotes bool
+	CsvBOM        bool
+
+	LuaStyle       string
+	LuaLongStrings bool
+	LuaTime        time.Duration
+	LuaMemory      uint64
+	Empty          string
+	TimeFormat     string
+	TimeZone       string
+
+	LocDir     string
+	LocSource  string
+	LocLangs   []string
+	LocTable   string
+	LocRuntime []string
+}
+
+type JobOutput struct {
+	Type string
+	Dir  string
+	Side string
+}
+
+func luaField(t *lua.LTable, name string, def string) string {
+	v := t.RawGetString(name)
+	if v.Type() == lua.LTNil {
+		return def
+	}
+	return v.String()
+}
+
+func luaStrings(v lua.LValue) []string {
+	switch v.Type() {
+	case lua.LTString:
+		return []string{v.String()}
+	case lua.LTTable:
+		var result []string
+		v.(*lua.LTable).ForEach(func(k, vv lua.LValue) {
+			result = append(result, vv.String())
+		})
+		return result
+	default:
+		return nil
+	}
+}
+
+func parseJob(index int, t *lua.LTable) (*Job, error) {
+	job := &Job{
+		Name:  luaField(t, "name", fmt.Sprint("job", index)),
+		Input: luaStrings(t.RawGetString("input")),
+		Sheet: luaField(t, "sheet", "Sheet1"),
+		Key:   luaField(t, "key", ""),
+		Force: lua.LVAsBool(t.RawGetString("force")),
+
+		ConstraintRow: int(lua.LVAsNumber(t.RawGetString("constraint_row"))),
+		Enums:         luaStrings(t.RawGetString("enums")),
+		IDRange:       luaField(t, "id_range", ""),
+
+		HeaderRow:     1,
+		TypeRow:       int(lua.LVAsNumber(t.RawGetString("type_row"))),
+		DescRow:       int(lua.LVAsNumber(t.RawGetString("desc_row"))),
+		DataRow:       int(lua.LVAsNumber(t.RawGetString("data_row"))),
+		CommentPrefix: luaField(t, "comment", ""),
+		FillMerged:    lua.LVAsBool(t.RawGetString("fill_merged")),
+		SkipHidden:    luaStrings(t.RawGetString("skip_hidden")),
+		Formula:       luaField(t, "formula", "cached"),
+
+		CsvSep:        luaField(t, "csv_sep", ","),
+		CsvComment:    luaField(t, "csv_comment", ""),
+		CsvEncoding:   luaField(t, "csv_encoding", "auto"),
+		CsvLazyQuotes: lua.LVAsBool(t.RawGetString("csv_lazy_quotes")),
+		CsvBOM:        lua.LVAsBool(t.RawGetString("csv_bom")),
+
+		LuaStyle:       luaField(t, "lua_style", "global"),
+		LuaLongStrings: lua.LVAsBool(t.RawGetString("lua_long_strings")),
+		LuaTime:        5 * time.Second,
+		LuaMemory:      256 << 20,
+		Empty:          luaField(t, "empty", "omit"),
+		TimeFormat:     luaField(t, "time_format", "unix"),
+		TimeZone:       luaField(t, "timezone", "Local"),
+
+		LocDir:     luaField(t, "loc_dir", ""),
+		LocSource:  luaField(t, "loc_source", "zh"),
+		LocLangs:   luaStrings(t.RawGetString("loc_langs")),
+		LocTable:   luaField(t, "loc_table", "csv"),
+		LocRuntime: []string{"lua"},
+	}
+	if v := t.RawGetString("loc_runtime"); v.Type() != lua.LTNil {
+		job.LocRuntime = luaStrings(v)
+	}
+	if v := t.RawGetString("lua_time"); v.Type() != lua.LTNil {
+		d, err := time.ParseDuration(v.String())
+		if err != nil {
+			return nil, errors.New("job " + job.Name + " lua_time: " + err.Error())
+		}
+		job.LuaTime = d
+	}
+	if v := t.RawGetString("header_row"); v.Type() == lua.LTNumber {
+		job.HeaderRow = int(lua.LVAsNumber(v))
+	}
+	if v := t.RawGetString("lua_memory"); v.Type() == lua.LTNumber {
+		job.LuaMemory = uint64(lua.LVAsNumber(v)) << 20
+	}
+	if len(job.Input) == 0 {
+		return nil, errors.New("job " + job.Name + " has no input")
+	}
+
+	outputs, ok := t.RawGetString("output").(*lua.LTable)
+	if !ok {
+		return nil, errors.New("job " + job.Name + " has no output")
+	}
+	var err error
+	outputs.ForEach(func(k, v lua.LValue) {
+		o, ok := v.(*lua.LTable)
+		if !ok {
+			err = errors.New("job " + job.Name + " output must be a table")
+			return
+		}
+		side := luaField(o, "side", "all")
+		if _, ok := sides[side]; !ok {
+			err = errors.New("job " + job.Name + " output side must be client, server or all")
+			return
+		}
+		job.Output = append(job.Output, JobOutput{Type: luaField(o, "type", ""), Dir: luaField(o, "dir", "."), Side: side})
+	})
+	return job, err
+}
+
+func LoadProject(name string) ([]*Job, error) {
+	L := luaSandbox()
+	defer L.Close()
+	if _, err := luaDoFile(L, name); err != nil {
+		return nil, err
+	}
+
+	t, ok := L.GetGlobal("jobs").(*lua.LTable)
+	if !ok {
+		return nil, errors.New(name + " does not define jobs")
+	}
+
+	var jobs []*Job
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		jt, ok := v.(*lua.LTable)
+		if !ok {
+			err = errors.New(name + " job " + k.String() + " must be a table")
+			return
+		}
+		var job *Job
+		if job, err = parseJob(len(jobs)+1, jt); err == nil {
+			jobs = append(jobs, job)
+		}
+	})
+	return jobs, err
+}
+
+// globBase returns the leading directories of pattern that contain no wildcard.
+func globBase(pattern string) string {
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for ; i < len(parts)-1; i++ {
+		if strings.ContainsAny(parts[i], "*?[") {
+			break
+		}
+	}
+	if i == 0 {
+		return "."
+	}
+	return filepath.FromSlash(strings.Join(parts[:i], "/"))
+}
+
+// globRegexp translates pattern to a regexp, "**/" matches any number of directories.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	expr := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("invalid pattern " + pattern)
+			}
+			expr += pattern[i : i+end+1]
+			i += end
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return regexp.Compile(expr + "$")
+}
+
+// Glob returns the directory the pattern is relative to and the files it matches.
+func Glob(pattern string) (string, []string, error) {
+	base := globBase(pattern)
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return base, nil, err
+	}
+
+	var files []string
+	err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && re.MatchString(filepath.ToSlash(filepath.Clean(path))) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return base, files, err
+}
+
+func (job *Job) Run(c *Converter) {
+	SetSheetName(job.Sheet)
+	SetConstraintRow(job.ConstraintRow)
+	SetLuaLongStrings(job.LuaLongStrings)
+	SetLuaLimits(job.LuaTime, job.LuaMemory)
+	SetForce(job.Force || _force)
+	if err := SetIDRange(job.IDRange); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetLayout(job.HeaderRow, job.TypeRow, job.DescRow, job.DataRow, job.CommentPrefix); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetXlsxOptions(job.FillMerged, job.SkipHidden); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetFormulaPolicy(job.Formula); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetCsvDialect(job.CsvSep, job.CsvComment, job.CsvEncoding, job.CsvLazyQuotes, job.CsvBOM); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	// the enum files are read like the inputs of the job
+	if err := LoadEnums(job.Enums); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetLuaStyle(job.LuaStyle); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetEmptyPolicy(job.Empty); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetTimeOptions(job.TimeFormat, job.TimeZone); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+	if err := SetLocalization(job.LocDir, job.LocSource, job.LocLangs, job.LocTable, job.LocRuntime); err != nil {
+		log.Println("job", job.Name, err)
+		c.Failed++
+		return
+	}
+
+	converted, uptodate, skipped, failed := c.Converted, c.UpToDate, c.Skipped, c.Failed
+	for _, pattern := range job.Input {
+		base, files, err := Glob(pattern)
+		if err != nil {
+			log.Println("job", job.Name, pattern, err)
+			c.Failed++
+			continue
+		}
+
+		for _, path := range files {
+			itype := strings.TrimPrefix(filepath.Ext(path), ".")
+			for _, o := range job.Output {
+				// the sides are checked by parseJob
+				SetSide(o.Side)
+				opath, err := outputPath(base, o.Dir, path, itype, o.Type)
+				if err == nil {
+					err = c.ConvertFile(o.Dir, path, opath, itype, o.Type, job.Key)
+				}
+				if err != nil {
+					log.Println("job", job.Name, path, err)
+					c.Failed++
+				}
+			}
+		}
+	}
+
+	log.Println("job", job.Name, ":", c.Converted-converted, "converted,", c.UpToDate-uptodate, "up to date,", c.Skipped-skipped, "skipped,", c.Failed-failed, "failed")
+}
+
+func runBuild(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	force := fs.Bool("f", false, "-f convert all files, ignoring the cache")
+	dryrun := fs.Bool("dry-run", false, "-dry-run print what would be converted, skipped and removed without writing anything")
+	fs.Usage = commandUsage(fs, "build [-f] [-dry-run] [project file]")
+	fs.Parse(args)
+
+	project := "goconf.lua"
+	if fs.NArg() > 0 {
+		project = fs.Arg(0)
+	}
+
+	jobs, err := LoadProject(project)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	c := NewConverter()
+	c.DryRun = *dryrun
+	for _, job := range jobs {
+		SetForce(*force)
+		job.Run(c)
+	}
+	c.Close()
+
+	log.Println("build:", c.Converted, "converted,", c.UpToDate, "up to date,", c.Skipped, "skipped,", c.Failed, "failed")
+	if c.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const Version = "0.2.0"
+
+const manifestName = ".goconf.manifest"
+
+type cacheEntry struct {
+	Input   string   `json:"input"`
+	Hash    string   `json:"hash"`
+	Options string   `json:"options"`
+	Refs    []string `json:"refs,omitempty"`
+}
+
+// Manifest records which input produced each file in an output directory,
+// so unchanged inputs can be skipped on the next run.
+type Manifest struct {
+	Version string                 `json:"version"`
+	Files   map[string]*cacheEntry `json:"files"`
+
+	path string
+}
+
+var _force bool = false
+
+func SetForce(f bool) {
+	_force = f
+}
+
+func LoadManifest(odir string) *Manifest {
+	m := &Manifest{Version: Version, Files: map[string]*cacheEntry{}, path: filepath.Join(odir, manifestName)}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return m
+	}
+
+	var old Manifest
+	if err := json.Unmarshal(data, &old); err != nil {
+		log.Println(m.path, err)
+		return m
+	}
+	if old.Files != nil {
+		m.Files = old.Files
+	}
+	if old.Version != Version {
+		// outputs are still tracked so they can be pruned, but none is up to date
+		for _, e := range m.Files {
+			e.Hash = ""
+		}
+	}
+	return m
+}
+
+func (m *Manifest) Save() error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0644)
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func absPath(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// UpToDate reports whether output was produced from the current content of
+// input with the same options. It also returns the input hash for Record.
+func (m *Manifest) UpToDate(input, output, options string) (bool, string) {
+	hash, err := fileHash(input)
+	if err != nil {
+		return false, ""
+	}
+	if _force {
+		return false, hash
+	}
+
+	e, ok := m.Files[absPath(output)]
+	if !ok || e.Input != absPath(input) || e.Hash != hash || e.Options != options {
+		return false, hash
+	}
+	if _, err := os.Stat(output); err != nil {
+		return false, hash
+	}
+	return true, hash
+}
+
+// Record stores that output was produced from input, refs are the tables
+// input references.
+func (m *Manifest) Record(input, output, hash, options string, refs []string) {
+	m.Files[absPath(output)] = &cacheEntry{Input: absPath(input), Hash: hash, Options: options, Refs: refs}
+}
+
+// Refs returns the tables referenced by the input of output when it was converted.
+func (m *Manifest) Refs(output string) []string {
+	if e, ok := m.Files[absPath(output)]; ok {
+		return e.Refs
+	}
+	return nil
+}
+
+// Stale returns the outputs whose input file no longer exists.
+func (m *Manifest) Stale() map[string]*cacheEntry {
+	result := map[string]*cacheEntry{}
+	for output, e := range m.Files {
+		if _, err := os.Stat(e.Input); os.IsNotExist(err) {
+			result[output] = e
+		}
+	}
+	return result
+}
+
+// Prune removes outputs whose input file no longer exists.
+func (m *Manifest) Prune() {
+	for output, e := range m.Stale() {
+		log.Println("remove", output, "input", e.Input, "deleted")
+		if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+			log.Println(output, err)
+			continue
+		}
+		delete(m.Files, output)
+	}
+}
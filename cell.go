@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Cell types hold a whole array or table in one cell:
+//
+//	Costs_AN   1|2|3              array of numbers, also _AS and _AB
+//	Grid_AAN   1,2;3,4            array of arrays, also _AAS and _AAB
+//	Extra_J    {"id":1,"n":2}     json value
+//	Extra_LT   {id=1, n=2}        lua table constructor
+//
+// a backslash escapes a separator or backslash inside an element, like a\|b.
+var cellTypes = map[string]bool{"AN": true, "AS": true, "AB": true, "AAN": true, "AAS": true, "AAB": true, "J": true, "LT": true}
+
+// splitEscaped splits s at sep, separators escaped with a backslash are kept
+// with their escape.
+func splitEscaped(s string, sep byte) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// cellElements returns the element texts of a cell array, rows of arrays
+// of arrays one after the other, and the number of elements or rows.
+func cellElements(typ, cell string) ([]string, int) {
+	if typ[:2] == "AA" {
+		rows := splitEscaped(cell, ';')
+		var result []string
+		for _, row := range rows {
+			for _, e := range splitEscaped(row, ',') {
+				result = append(result, unescape(e))
+			}
+		}
+		return result, len(rows)
+	}
+	elements := splitEscaped(cell, '|')
+	for i, e := range elements {
+		elements[i] = unescape(e)
+	}
+	return elements, len(elements)
+}
+
+func elementValue(typ byte, text, enum string) (interface{}, error) {
+	switch typ {
+	case 'N':
+		if enum != "" {
+			v, err := enumValue(enum, text)
+			if err != nil {
+				return nil, err
+			}
+			text = v
+		}
+		n, err := parseNumber(strings.TrimSpace(text))
+		if err != nil {
+			return nil, errors.New("invalid number " + strconv.Quote(text))
+		}
+		return n, nil
+	case 'B':
+		b, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return nil, errors.New("invalid bool " + strconv.Quote(text))
+		}
+		return b, nil
+	default:
+		return text, nil
+	}
+}
+
+// cellValue parses the cell of a cell type column, enum translates the
+// elements of number arrays.
+func cellValue(typ, cell, enum string) (interface{}, error) {
+	switch typ {
+	case "AN", "AS", "AB":
+		elements := splitEscaped(cell, '|')
+		result := make([]interface{}, len(elements))
+		for i, e := range elements {
+			v, err := elementValue(typ[1], unescape(e), enum)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i+1, err)
+			}
+			result[i] = v
+		}
+		return result, nil
+	case "AAN", "AAS", "AAB":
+		rows := splitEscaped(cell, ';')
+		result := make([]interface{}, len(rows))
+		for i, row := range rows {
+			elements := splitEscaped(row, ',')
+			a := make([]interface{}, len(elements))
+			for j, e := range elements {
+				v, err := elementValue(typ[2], unescape(e), enum)
+				if err != nil {
+					return nil, fmt.Errorf("row %d element %d: %v", i+1, j+1, err)
+				}
+				a[j] = v
+			}
+			result[i] = a
+		}
+		return result, nil
+	case "J":
+		dec := json.NewDecoder(strings.NewReader(cell))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			if serr, ok := err.(*json.SyntaxError); ok {
+				return nil, fmt.Errorf("invalid json at offset %d: %v", serr.Offset, err)
+			}
+			return nil, errors.New("invalid json: " + err.Error())
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, fmt.Errorf("invalid json at offset %d: data after the value", dec.InputOffset())
+		}
+		return jsonValue(v), nil
+	case "LT":
+		return luaTableValue(cell)
+	default:
+		panic("invalid type")
+	}
+}
+
+// luaTableValue evaluates a lua table constructor in the sandbox.
+func luaTableValue(cell string) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	L := luaSandbox()
+	defer L.Close()
+	fn, err := L.LoadString("return " + cell)
+	if err != nil {
+		return nil, errors.New("invalid lua: " + err.Error())
+	}
+	v, err := luaCall(L, fn, "cell")
+	if err != nil {
+		return nil, err
+	}
+	if v.Type() != lua.LTTable {
+		return nil, errors.New("not a lua table: " + strconv.Quote(cell))
+	}
+	return luaValueToInterface(v), nil
+}
+
+// checkElements checks the elements of a cell array against c.
+func (c *Constraint) checkElements(cell string, col column) string {
+	if col.Type == "J" || col.Type == "LT" {
+		return ""
+	}
+	elements, n := cellElements(col.Type, cell)
+	if c.MinCount >= 0 && n < c.MinCount || c.MaxCount >= 0 && n > c.MaxCount {
+		return fmt.Sprintf("%d elements out of range %d..%d", n, c.MinCount, c.MaxCount)
+	}
+	elem := column{Type: col.Type[len(col.Type)-1:]}
+	for i, e := range elements {
+		if enum := col.Enum(); enum != "" {
+			e, _ = enumValue(enum, e)
+		}
+		if msg := c.checkCell(e, elem); msg != "" {
+			return fmt.Sprintf("element %d: %s", i+1, msg)
+		}
+	}
+	return ""
+}
+
+func escapeElement(s, seps string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || strings.IndexByte(seps, s[i]) != -1 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+func elementText(v interface{}, seps string) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return escapeElement(v, seps)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return formatNumber(v)
+	}
+}
+
+// jsonText returns v as compact json, keys sorted.
+func jsonText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return jsonQuote(v)
+	case LuaCode:
+		return jsonQuote(string(v))
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		var items []string
+		for _, e := range v {
+			items = append(items, jsonText(e))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	case StringKeyed:
+		return jsonText(map[string]interface{}(v))
+	case *LuaTable:
+		m := map[string]interface{}{jsonArrayPart: v.Array}
+		for k, e := range v.Hash {
+			m[k] = e
+		}
+		return jsonText(m)
+	case map[string]interface{}:
+		var items []string
+		for _, k := range sortedKeys(v) {
+			items = append(items, jsonQuote(k)+":"+jsonText(v[k]))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	default:
+		return formatNumber(v)
+	}
+}
+
+// luaText returns v as a lua constructor on one line, keys sorted.
+func luaText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return luaQuote(v)
+	case LuaCode:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		var items []string
+		for _, e := range v {
+			items = append(items, luaText(e))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	case StringKeyed:
+		var items []string
+		for _, k := range sortedKeys(v) {
+			items = append(items, luaKey(k, true)+"="+luaText(v[k]))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	case *LuaTable:
+		var items []string
+		for _, e := range v.Array {
+			items = append(items, luaText(e))
+		}
+		for _, k := range sortedKeys(v.Hash) {
+			items = append(items, luaKey(k, false)+"="+luaText(v.Hash[k]))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	case map[string]interface{}:
+		var items []string
+		for _, k := range sortedKeys(v) {
+			items = append(items, luaKey(k, false)+"="+luaText(v[k]))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	default:
+		return formatNumber(v)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatCell writes v in the syntax of the cell type typ.
+func formatCell(typ string, v interface{}) string {
+	switch typ {
+	case "J":
+		return jsonText(v)
+	case "LT":
+		return luaText(v)
+	}
+
+	a, _ := v.([]interface{})
+	var items []string
+	for _, e := range a {
+		if typ[:2] != "AA" {
+			items = append(items, elementText(e, "|"))
+			continue
+		}
+		row, _ := e.([]interface{})
+		var elements []string
+		for _, ee := range row {
+			elements = append(elements, elementText(ee, ",;"))
+		}
+		items = append(items, strings.Join(elements, ","))
+	}
+	if typ[:2] == "AA" {
+		return strings.Join(items, ";")
+	}
+	return strings.Join(items, "|")
+}
+
+// collapseColumns writes the path columns of data, whose name header
+// declares with a cell type, back to one column in the syntax of the type.
+func collapseColumns(data [][]string, header []string) [][]string {
+	old, cur := &TableConfig{}, &TableConfig{}
+	if old.init(header) != nil || cur.init(data[0]) != nil {
+		return data
+	}
+
+	drop := map[int]bool{}
+	for name, cols := range old.cols {
+		decl := cols[0]
+		paths, ok := cur.cols[name]
+		if !cellTypes[decl.Type] || !ok || !paths[0].isPath() {
+			continue
+		}
+
+		first := paths[0].Index
+		for _, p := range paths {
+			if p.Index < first {
+				first = p.Index
+			}
+			drop[p.Index] = true
+		}
+		drop[first] = false
+
+		data[0][first] = header[decl.Index]
+		for i := 1; i < len(data); i++ {
+			var value interface{}
+			for _, p := range paths {
+				if cell := cellOf(data[i], p.Index); cell != "" {
+					if v, err := p.Value(cell); err == nil {
+						value = setPath(value, p.Path, v)
+					}
+				}
+			}
+			if first < len(data[i]) {
+				data[i][first] = ""
+				if value != nil {
+					data[i][first] = formatCell(decl.Type, value)
+				}
+			}
+		}
+	}
+
+	for i, row := range data {
+		var kept []string
+		for j, cell := range row {
+			if !drop[j] {
+				kept = append(kept, cell)
+			}
+		}
+		data[i] = kept
+	}
+	return data
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLuaTableCell(t *testing.T) {
+	v, err := cellValue("LT", `{1, 2, k="v"}`, "")
+	want := &LuaTable{Array: []interface{}{int64(1), int64(2)}, Hash: map[string]interface{}{"k": "v"}}
+	if err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, %v, want %#v", v, err, want)
+	}
+
+	// values lua cannot write back are errors, not crashes
+	for _, cell := range []string{
+		"{f=print}",
+		"{f=function() end}",
+		"{[{}]=1}",
+	} {
+		if v, err := cellValue("LT", cell, ""); err == nil {
+			t.Errorf("%s = %#v, want an error", cell, v)
+		}
+	}
+}
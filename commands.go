@@ -0,0 +1,722 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileType returns the conversion type of path from its extension, or "" when not supported.
+func fileType(path string) string {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if _, ok := newfunc[ext]; ok {
+		return ext
+	}
+	return ""
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// walkInputs calls fn for input if it is a file, or for every file of type
+// itype under input if it is a directory. An empty itype matches every
+// supported type.
+func walkInputs(input, itype string, fn func(path, itype string)) error {
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if itype == "" {
+			itype = fileType(input)
+		}
+		if itype == "" {
+			return errors.New("can not infer the type of " + input + ", use -it")
+		}
+		fn(input, itype)
+		return nil
+	}
+
+	return filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			if t := fileType(path); t != "" && (itype == "" || t == itype) {
+				fn(path, t)
+			}
+		}
+		return nil
+	})
+}
+
+func openInput(path, itype string) (Helper, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	if itype == "" {
+		itype = fileType(path)
+	}
+	newf, ok := newfunc[itype]
+	if !ok {
+		return nil, errors.New("can not infer the type of " + path + ", use -it")
+	}
+	return newf(path)
+}
+
+func runConvert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	input := fs.String("i", "test", "-i input dir or file")
+	output := fs.String("o", "test", "-o output dir or file")
+	itype := fs.String("it", "", "-it type to convert, inferred from the input file extension")
+	otype := fs.String("ot", "", "-ot type convert to, inferred from the output file extension")
+	key := fs.String("k", "ID", "-k key")
+	sheet := fs.String("s", "Sheet1", "-s sheet")
+	crow := fs.Int("cr", 0, "-cr row number of the column constraints, 0 for none")
+	enums := fs.String("enum", "", "-enum comma separated files defining the enums")
+	idrange := fs.String("idrange", "", "-idrange min..max range of the keys")
+	luastyle := fs.String("luastyle", "global", "-luastyle lua output defines a global, or returns the table as local, module or readonly")
+	lualong := fs.Bool("lualong", false, "-lualong write multi-line strings to lua as long brackets [[...]]")
+	luatime := fs.Duration("luatime", 5*time.Second, "-luatime time a lua input may run, 0 for no limit")
+	luamem := fs.Uint64("luamem", 256, "-luamem megabytes a lua input may allocate, 0 for no limit")
+	empty := fs.String("empty", "omit", "-empty policy for empty cells of columns not declaring one: omit, default, null or error")
+	timefmt := fs.String("time", "unix", "-time write dates as unix timestamps or iso 8601")
+	tz := fs.String("tz", "Local", "-tz time zone of dates without one, like Asia/Shanghai")
+	side := fs.String("side", "all", "-side export the columns and rows of the client, the server or all")
+	locdir := fs.String("locdir", "", "-locdir directory of the string tables of the @Loc columns, empty to keep their text")
+	lang := fs.String("lang", "zh", "-lang language of the text in the sheets")
+	langs := fs.String("langs", "", "-langs comma separated languages to translate to")
+	loctype := fs.String("loctype", "csv", "-loctype type of the string tables for translators, csv or xlsx")
+	locout := fs.String("locout", "lua", "-locout comma separated types of the string tables for the game, lua or json")
+	setLayout := layoutFlags(fs)
+	setCsv := csvFlags(fs)
+	setXlsx := xlsxFlags(fs)
+	force := fs.Bool("f", false, "-f convert all files, ignoring the cache")
+	dryrun := fs.Bool("dry-run", false, "-dry-run print what would be converted, skipped and removed without writing anything")
+	fs.Usage = commandUsage(fs, "convert [-i dir|file] [-o dir|file] [-it type] [-ot type] [-k key] [-s sheet] [-cr row] [-enum files] [-idrange min..max] [-luastyle style] [-lualong] [-luatime duration] [-luamem MB] [-empty policy] [-time unix|iso] [-tz zone] [-side side] [-locdir dir] [-lang lang] [-langs langs] [-loctype csv|xlsx] [-locout types] [-hr row] [-tr row] [-dr row] [-fr row] [-comment prefix] [-fillmerged] [-skiphidden rows,cols,sheets] [-formula cached|eval] [-csvsep sep] [-csvcomment char] [-csvenc encoding] [-csvlazy] [-csvbom] [-f] [-dry-run]")
+	fs.Parse(args)
+
+	SetSheetName(*sheet)
+	SetConstraintRow(*crow)
+	if err := setLayout(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := setCsv(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := setXlsx(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := LoadEnums(splitList(*enums)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetIDRange(*idrange); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetLuaStyle(*luastyle); err != nil {
+		log.Println(err)
+		return 1
+	}
+	SetLuaLongStrings(*lualong)
+	SetLuaLimits(*luatime, *luamem<<20)
+	if err := SetEmptyPolicy(*empty); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetTimeOptions(*timefmt, *tz); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetSide(*side); err != nil {
+		log.Println(err)
+		return 1
+	}
+	SetForce(*force)
+
+	single := !isDir(*input)
+	if *itype == "" && single {
+		*itype = fileType(*input)
+	}
+	tofile := single && !isDir(*output) && fileType(*output) != ""
+	if *otype == "" && tofile {
+		*otype = fileType(*output)
+	}
+	if *itype == "" || *otype == "" {
+		log.Println("can not infer the types to convert, use -it and -ot")
+		return 1
+	}
+	if _, _, err := convertFuncOf(*itype, *otype, *key); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	c := NewConverter()
+	c.DryRun = *dryrun
+	if err := SetLocalization(*locdir, *lang, splitList(*langs), *loctype, splitList(*locout)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if single {
+		odir, opath := *output, ""
+		var err error
+		if tofile {
+			odir, opath = filepath.Dir(*output), *output
+		} else {
+			opath, err = outputPath(filepath.Dir(*input), odir, *input, *itype, *otype)
+		}
+		if err == nil {
+			err = c.ConvertFile(odir, *input, opath, *itype, *otype, *key)
+		}
+		if err != nil {
+			log.Println(*input, err)
+			c.Failed++
+		}
+	} else {
+		c.ConvertDir(*input, *output, *itype, *otype, *key)
+	}
+	c.Close()
+
+	if c.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateFile reads path and checks its rows against the header type
+// declarations and column constraints, it returns every problem found.
+func validateFile(path, itype, key string) []string {
+	h, err := openInput(path, itype)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if hiddenSheet(h) {
+		log.Println(path, "skipped, sheet", _sheet, "is hidden")
+		return nil
+	}
+
+	if itype == "lua" || itype == "json" {
+		if _, err := h.ReadMap(key); err != nil {
+			return []string{err.Error()}
+		}
+		return nil
+	}
+
+	data, err := readSheet(h)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	t, err := LoadTable(path, data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if t.HasSchema() {
+		_refs.Add(path, t, data)
+		var result []string
+		for _, v := range t.Validate(data) {
+			result = append(result, v.String())
+		}
+		return result
+	}
+
+	data = untypedSide(data)
+	header := map[string]bool{}
+	for _, h := range data[0] {
+		if h == "" {
+			continue
+		}
+		if header[h] {
+			return []string{"duplicate header " + h}
+		}
+		header[h] = true
+	}
+	if key != "" && !header[key] {
+		return []string{"not has key " + key}
+	}
+
+	kindex := -1
+	for j, h := range data[0] {
+		if h == key {
+			kindex = j
+		}
+	}
+	var result []string
+	for i := dataRow(); i < len(data); i++ {
+		if isBlank(data[i]) {
+			continue
+		}
+		if _, err := rowMap(data[0], data[i], i, kindex); err != nil {
+			result = append(result, err.Error())
+		}
+	}
+	return result
+}
+
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	itype := fs.String("it", "", "-it type of the inputs, inferred from the file extension")
+	key := fs.String("k", "", "-k key column required in sheets without type declarations")
+	sheet := fs.String("s", "Sheet1", "-s sheet")
+	crow := fs.Int("cr", 0, "-cr row number of the column constraints, 0 for none")
+	enums := fs.String("enum", "", "-enum comma separated files defining the enums")
+	idrange := fs.String("idrange", "", "-idrange min..max range of the keys")
+	luatime := fs.Duration("luatime", 5*time.Second, "-luatime time a lua input may run, 0 for no limit")
+	luamem := fs.Uint64("luamem", 256, "-luamem megabytes a lua input may allocate, 0 for no limit")
+	empty := fs.String("empty", "omit", "-empty policy for empty cells of columns not declaring one: omit, default, null or error")
+	timefmt := fs.String("time", "unix", "-time write dates as unix timestamps or iso 8601")
+	tz := fs.String("tz", "Local", "-tz time zone of dates without one, like Asia/Shanghai")
+	setLayout := layoutFlags(fs)
+	setCsv := csvFlags(fs)
+	setXlsx := xlsxFlags(fs)
+	fs.Usage = commandUsage(fs, "validate [-it type] [-k key] [-s sheet] [-cr row] [-enum files] [-idrange min..max] [-luatime duration] [-luamem MB] [-empty policy] [-time unix|iso] [-tz zone] [-hr row] [-tr row] [-dr row] [-fr row] [-comment prefix] [-fillmerged] [-skiphidden rows,cols,sheets] [-formula cached|eval] [-csvsep sep] [-csvcomment char] [-csvenc encoding] [-csvlazy] [-csvbom] dir|file...")
+	fs.Parse(args)
+
+	SetSheetName(*sheet)
+	SetConstraintRow(*crow)
+	if err := setLayout(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := setCsv(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := setXlsx(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	SetLuaLimits(*luatime, *luamem<<20)
+	if err := SetEmptyPolicy(*empty); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetTimeOptions(*timefmt, *tz); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := LoadEnums(splitList(*enums)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetIDRange(*idrange); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	failed := 0
+	for _, input := range fs.Args() {
+		err := walkInputs(input, *itype, func(path, itype string) {
+			for _, msg := range validateFile(path, itype, *key) {
+				fmt.Println(path+":", msg)
+				failed++
+			}
+		})
+		if err != nil {
+			log.Println(input, err)
+			failed++
+		}
+	}
+	for _, msg := range _refs.Check() {
+		fmt.Println(msg)
+		failed++
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// rowsByKey indexes the data rows by the value in column key, or by row number without key.
+func rowsByKey(data [][]string, key string) (map[string][]string, []string) {
+	kindex := -1
+	for i, h := range data[0] {
+		if h == key {
+			kindex = i
+		}
+	}
+
+	rows := map[string][]string{}
+	var order []string
+	for i := 1; i < len(data); i++ {
+		k := fmt.Sprint("row ", i+1)
+		if kindex != -1 && kindex < len(data[i]) {
+			k = key + "=" + data[i][kindex]
+		}
+		if _, ok := rows[k]; !ok {
+			order = append(order, k)
+		}
+		rows[k] = data[i]
+	}
+	return rows, order
+}
+
+func cellOf(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
+
+// diffData prints the differences between the data of a and b and returns how many there are.
+func diffData(a, b [][]string, key string) int {
+	if len(a) == 0 || len(b) == 0 {
+		if len(a) != len(b) {
+			fmt.Println("one of the files is empty")
+			return 1
+		}
+		return 0
+	}
+
+	aheader, bheader := map[string]int{}, map[string]int{}
+	for i, h := range a[0] {
+		aheader[h] = i
+	}
+	for i, h := range b[0] {
+		bheader[h] = i
+	}
+
+	count := 0
+	var columns []string
+	for h := range aheader {
+		if _, ok := bheader[h]; !ok {
+			fmt.Println("- column", h)
+			count++
+		} else {
+			columns = append(columns, h)
+		}
+	}
+	for h := range bheader {
+		if _, ok := aheader[h]; !ok {
+			fmt.Println("+ column", h)
+			count++
+		}
+	}
+	sort.Strings(columns)
+
+	arows, aorder := rowsByKey(a, key)
+	brows, border := rowsByKey(b, key)
+	for _, k := range aorder {
+		brow, ok := brows[k]
+		if !ok {
+			fmt.Println("-", k)
+			count++
+			continue
+		}
+		for _, h := range columns {
+			av, bv := cellOf(arows[k], aheader[h]), cellOf(brow, bheader[h])
+			if av != bv {
+				fmt.Printf("~ %s %s: %q -> %q\n", k, h, av, bv)
+				count++
+			}
+		}
+	}
+	for _, k := range border {
+		if _, ok := arows[k]; !ok {
+			fmt.Println("+", k)
+			count++
+		}
+	}
+	return count
+}
+
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	key := fs.String("k", "ID", "-k key column matching the rows, rows are matched by position without it")
+	sheet := fs.String("s", "Sheet1", "-s sheet")
+	setCsv := csvFlags(fs)
+	fs.Usage = commandUsage(fs, "diff [-k key] [-s sheet] [-csvsep sep] [-csvcomment char] [-csvenc encoding] [-csvlazy] [-csvbom] file1 file2")
+	fs.Parse(args)
+
+	SetSheetName(*sheet)
+	if err := setCsv(); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+	}
+
+	var data [2][][]string
+	for i := 0; i < 2; i++ {
+		h, err := openInput(fs.Arg(i), "")
+		if err == nil {
+			data[i], err = h.ReadArray()
+		}
+		if err != nil {
+			log.Println(fs.Arg(i), err)
+			return 2
+		}
+	}
+
+	if diffData(data[0], data[1], *key) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	sheet := fs.String("s", "Sheet1", "-s sheet")
+	setLayout := layoutFlags(fs)
+	setCsv := csvFlags(fs)
+	fs.Usage = commandUsage(fs, "inspect [-s sheet] [-hr row] [-tr row] [-dr row] [-fr row] [-comment prefix] [-csvsep sep] [-csvcomment char] [-csvenc encoding] [-csvlazy] [-csvbom] file...")
+	fs.Parse(args)
+
+	SetSheetName(*sheet)
+	if err := setLayout(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := setCsv(); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		h, err := openInput(path, "")
+		if err != nil {
+			log.Println(path, err)
+			failed++
+			continue
+		}
+
+		fmt.Println(path)
+		fmt.Println("  type:", fileType(path))
+		if x, ok := h.(*XlsxHelper); ok {
+			for _, s := range x.file.Sheets {
+				if s.Hidden {
+					fmt.Println("  sheet:", s.Name, len(s.Rows), "rows, hidden")
+				} else {
+					fmt.Println("  sheet:", s.Name, len(s.Rows), "rows")
+				}
+			}
+		}
+
+		data, err := readSheet(h)
+		if err != nil {
+			log.Println(path, err)
+			failed++
+			continue
+		}
+		if len(data) == 0 {
+			fmt.Println("  empty")
+			continue
+		}
+		fmt.Println("  header:", strings.Join(data[0], ", "))
+		fmt.Println("  rows:", len(data)-1)
+
+		t := &TableConfig{}
+		if err := t.init(data[0]); err != nil {
+			fmt.Println("  header declarations:", err)
+		} else if t.HasSchema() {
+			if t.key.Index != -1 {
+				fmt.Println("  key:", t.key.Name, t.key.Type)
+			}
+			fmt.Println("  declared columns:", len(t.Columns()))
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// schemaNode is the type of a value built from the declared columns.
+type schemaNode struct {
+	Type   string
+	Desc   string
+	Elem   *schemaNode
+	Fields map[string]*schemaNode
+}
+
+func (n *schemaNode) add(path []interface{}, leaf, desc string) {
+	if len(path) == 0 {
+		n.Type = leaf
+		if n.Desc == "" {
+			n.Desc = desc
+		}
+		return
+	}
+
+	var next *schemaNode
+	switch k := path[0].(type) {
+	case int:
+		if n.Elem == nil {
+			n.Elem = &schemaNode{}
+		}
+		next = n.Elem
+	default:
+		if n.Fields == nil {
+			n.Fields = map[string]*schemaNode{}
+		}
+		next = n.Fields[k.(string)]
+		if next == nil {
+			next = &schemaNode{}
+			n.Fields[k.(string)] = next
+		}
+	}
+	next.add(path[1:], leaf, desc)
+}
+
+// description returns the description of n or of its elements, on one line.
+func (n *schemaNode) description() string {
+	for ; n != nil; n = n.Elem {
+		if n.Desc != "" {
+			return strings.Join(strings.Fields(n.Desc), " ")
+		}
+	}
+	return ""
+}
+
+// luaType returns the annotation type of n, classes for nested tables are appended to classes.
+func (n *schemaNode) luaType(name string, classes *[]string) string {
+	switch {
+	case n.Elem != nil:
+		return n.Elem.luaType(name, classes) + "[]"
+	case n.Fields != nil:
+		n.writeClass(name, classes)
+		return name
+	default:
+		return n.Type
+	}
+}
+
+func (n *schemaNode) writeClass(name string, classes *[]string) {
+	var names []string
+	for k := range n.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	class := "---@class " + name + "\n"
+	index := len(*classes)
+	*classes = append(*classes, "")
+	for _, k := range names {
+		class += "---@field " + k + " " + n.Fields[k].luaType(name+"_"+k, classes)
+		if desc := n.Fields[k].description(); desc != "" {
+			class += " " + desc
+		}
+		class += "\n"
+	}
+	(*classes)[index] = class
+}
+
+func columnLuaType(c column) string {
+	switch c.Type {
+	case "N":
+		return "number"
+	case "S":
+		return "string"
+	case "B":
+		return "boolean"
+	case "AN", "AS", "AB":
+		return columnLuaType(column{Type: c.Type[1:]}) + "[]"
+	case "AAN", "AAS", "AAB":
+		return columnLuaType(column{Type: c.Type[2:]}) + "[][]"
+	case "LT":
+		return "table"
+	case "DUR":
+		return "number"
+	case "DATE":
+		if _timeFormat == "iso" {
+			return "string"
+		}
+		return "integer"
+	default:
+		return "any"
+	}
+}
+
+// LuaSchema generates lua annotations for the rows of the table named name.
+func (t *TableConfig) LuaSchema(name string) string {
+	root := &schemaNode{}
+	for _, c := range t.Columns() {
+		if t.key.Index != -1 && c.Index == t.key.Index {
+			continue
+		}
+		root.add(append([]interface{}{c.Name}, c.Path...), columnLuaType(c), t.descriptions[c.Index])
+	}
+
+	var classes []string
+	root.writeClass(name, &classes)
+
+	result := strings.Join(classes, "\n")
+	if t.key.Index == -1 {
+		result += "\n---@alias " + name + "Table " + name + "[]\n"
+	} else if t.key.Type == "N" {
+		result += "\n---@alias " + name + "Table table<number, " + name + ">\n"
+	} else {
+		result += "\n---@alias " + name + "Table table<string, " + name + ">\n"
+	}
+	return result
+}
+
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	sheet := fs.String("s", "Sheet1", "-s sheet")
+	setLayout := layoutFlags(fs)
+	setCsv := csvFlags(fs)
+	fs.Usage = commandUsage(fs, "schema [-s sheet] [-hr row] [-tr row] [-dr row] [-fr row] [-comment prefix] [-csvsep sep] [-csvcomment char] [-csvenc encoding] [-csvlazy] [-csvbom] file...")
+	fs.Parse(args)
+
+	SetSheetName(*sheet)
+	if err := setLayout(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := setCsv(); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		h, err := openInput(path, "")
+		if err != nil {
+			log.Println(path, err)
+			failed++
+			continue
+		}
+
+		data, err := readSheet(h)
+		var t *TableConfig
+		if err == nil {
+			t, err = LoadTable(path, data)
+		}
+		if err == nil && !t.HasSchema() {
+			err = errors.New("header declares no column types")
+		}
+		if err != nil {
+			log.Println(path, err)
+			failed++
+			continue
+		}
+
+		basename := filepath.Base(path)
+		fmt.Print(t.LuaSchema(strings.TrimSuffix(basename, filepath.Ext(basename))))
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type convertFunc func(path string, ifile, cfile Helper, key string) error
+
+func aaConvert(path string, ifile, cfile Helper, key string) error {
+	data, err := ifile.ReadArray()
+	if err != nil {
+		return err
+	}
+
+	// keep the declarations of a sheet being overwritten
+	if old, err := cfile.ReadArray(); err == nil && len(old) > 0 {
+		data = restoreHeader(data, old[0])
+	}
+	return cfile.WriteArray(data)
+}
+
+func mmConvert(path string, ifile, cfile Helper, key string) error {
+	data, err := ifile.ReadMap(key)
+	if err != nil {
+		return err
+	}
+
+	return cfile.WriteMap(data)
+}
+
+func mmStringConvert(path string, ifile, cfile Helper, key string) error {
+	data, err := ifile.ReadMap(key)
+	if err != nil {
+		return err
+	}
+
+	return cfile.WriteMapString(data.(map[string]map[string]interface{}))
+}
+
+// tableConvert exports a sheet whose header declares the column types after
+// validating every cell, sheets without declarations are converted as before.
+func tableConvert(path string, ifile, cfile Helper, key string) error {
+	data, err := readSheet(ifile)
+	if err != nil {
+		return err
+	}
+
+	t, err := LoadTable(path, data)
+	if err != nil {
+		return err
+	}
+	if !t.HasSchema() {
+		if key == "" {
+			return cfile.WriteArray(dataRows(untypedSide(data)))
+		}
+		return mmStringConvert(path, ifile, cfile, key)
+	}
+
+	if violations := t.Validate(data); len(violations) > 0 {
+		for _, v := range violations {
+			log.Println(path, v)
+		}
+		return fmt.Errorf("%d violations, not exported", len(violations))
+	}
+
+	_refs.Add(path, t, data)
+	if _loc != nil {
+		data = _loc.Extract(path, t, data)
+	}
+	value, err := t.Parse(data)
+	if err != nil {
+		return err
+	}
+	return cfile.WriteMap(value)
+}
+
+// convertFuncOf returns the conversion between itype and otype and whether
+// it goes through "array", "keyed map" or "map" data.
+func convertFuncOf(itype, otype, key string) (convertFunc, string, error) {
+	ctype := itype + "2" + otype
+	switch {
+	case ctype == "xlsx2csv" || ctype == "csv2xlsx":
+		fallthrough
+	case ctype == "lua2xlsx" || ctype == "lua2csv":
+		fallthrough
+	case ctype == "json2xlsx" || ctype == "json2csv":
+		return aaConvert, "array", nil
+	case (ctype == "xlsx2json" || ctype == "csv2json") && key == "":
+		fallthrough
+	case (ctype == "xlsx2lua" || ctype == "csv2lua") && key == "":
+		return tableConvert, "array", nil
+	case (ctype == "xlsx2json" || ctype == "csv2json"):
+		fallthrough
+	case (ctype == "xlsx2lua" || ctype == "csv2lua"):
+		return tableConvert, "keyed map", nil
+	case (ctype == "json2lua" || ctype == "lua2json"):
+		return mmConvert, "map", nil
+	default:
+		return nil, "", errors.New("not support convert " + ctype)
+	}
+}
+
+// convertOptions describes everything besides the content of path that the
+// output depends on.
+func convertOptions(path, itype, otype, key string) string {
+	options := fmt.Sprint(itype, "2", otype, " key=", key, " sheet=", _sheet, " cr=", _constraintRow, " ids=", _idMin, "..", _idMax, " empty=", _emptyPolicy, " time=", _timeFormat, " tz=", _timeZone, " side=", _side, " layout=", _layout, " merged=", _fillMerged, " hidden=", strings.Join(_skipHidden, ","), " formula=", _formulaPolicy, " csv=", strconv.Quote(_csvSep+_csvComment), _csvEncoding, " ", _csvLazyQuotes, " ", _csvBOM)
+	if otype == "lua" {
+		options += " style=" + _luaStyle
+		if _luaLongStrings {
+			options += " lualong"
+		}
+	}
+	if _loc != nil {
+		// a new language or table type needs the strings of every input
+		options += " loc=" + _loc.Dir + " " + _loc.Source + ":" + strings.Join(_loc.Langs, ",") + " " + _loc.Table
+	}
+	if hash, err := fileHash(schemaFile(path)); err == nil {
+		options += " schema=" + hash
+	}
+	for _, enum := range _enumFiles {
+		if hash, err := fileHash(enum); err == nil {
+			options += " enum=" + hash
+		}
+	}
+	return options
+}
+
+// outputPath mirrors the location of path relative to idir under odir.
+func outputPath(idir, odir, path, itype, otype string) (string, error) {
+	rel, err := filepath.Rel(idir, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(odir, strings.TrimSuffix(rel, "."+itype)+"."+otype), nil
+}
+
+// Converter converts files and keeps one manifest per output directory,
+// so several conversions in one run share the cache.
+type Converter struct {
+	manifests map[string]*Manifest
+	outputs   map[string]string
+
+	// DryRun prints what each conversion would do instead of doing it
+	DryRun bool
+
+	Converted int
+	UpToDate  int
+	Skipped   int
+	Failed    int
+}
+
+func NewConverter() *Converter {
+	_refs = NewRefChecker()
+	_loc, _localizers = nil, map[string]*Localizer{}
+	return &Converter{manifests: map[string]*Manifest{}, outputs: map[string]string{}}
+}
+
+func (c *Converter) manifest(odir string) *Manifest {
+	m, ok := c.manifests[odir]
+	if !ok {
+		m = LoadManifest(odir)
+		c.manifests[odir] = m
+	}
+	return m
+}
+
+// ConvertFile converts path to opath, odir is the output directory whose
+// manifest tracks opath.
+func (c *Converter) ConvertFile(odir, path, opath, itype, otype, key string) error {
+	conv, kind, err := convertFuncOf(itype, otype, key)
+	if err != nil {
+		return err
+	}
+
+	// compare case-insensitively, the output may land on a case-insensitive filesystem
+	if other, ok := c.outputs[strings.ToLower(opath)]; ok {
+		if c.DryRun {
+			fmt.Println("skip     ", path, "->", opath, "collides with", other)
+		}
+		return errors.New("output " + opath + " collides with " + other)
+	}
+	c.outputs[strings.ToLower(opath)] = path
+
+	manifest := c.manifest(odir)
+	options := convertOptions(path, itype, otype, key)
+	uptodate, hash := manifest.UpToDate(path, opath, options)
+	sheet := itype == "xlsx" || itype == "csv"
+	if uptodate {
+		if sheet {
+			_refs.See(path, manifest.Refs(opath))
+		}
+		if c.DryRun {
+			fmt.Println("skip     ", path, "->", opath, "up to date")
+		} else {
+			log.Println(path, "up to date")
+		}
+		c.UpToDate++
+		return nil
+	}
+
+	if c.DryRun {
+		action := "create   "
+		if _, err := os.Stat(opath); err == nil {
+			action = "overwrite"
+		}
+		detail := itype + "2" + otype + " as " + kind
+		if itype == "xlsx" {
+			detail += " sheet=" + _sheet
+		}
+		if kind != "array" {
+			detail += " key=" + key
+		}
+		fmt.Println(action, path, "->", opath, detail)
+		c.Converted++
+		return nil
+	}
+
+	ifile, err := newfunc[itype](path)
+	if err != nil {
+		return err
+	}
+	if hiddenSheet(ifile) {
+		log.Println(path, "skipped, sheet", _sheet, "is hidden")
+		c.Skipped++
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opath), os.ModePerm); err != nil {
+		return err
+	}
+
+	log.Println(path, itype, otype)
+
+	cfile, err := newfunc[otype](opath)
+	if err != nil {
+		return err
+	}
+
+	if sheet {
+		_refs.See(path, nil)
+	}
+	if err := conv(path, ifile, cfile, key); err != nil {
+		return err
+	}
+	manifest.Record(path, opath, hash, options, _refs.Refs(path))
+	c.Converted++
+	return nil
+}
+
+func (c *Converter) ConvertDir(idir, odir, itype, otype, key string) {
+	filepath.Walk(idir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Fatal(err)
+			return err
+		}
+
+		if info.Mode().IsRegular() && filepath.Ext(path) == "."+itype {
+			opath, err := outputPath(idir, odir, path, itype, otype)
+			if err == nil {
+				err = c.ConvertFile(odir, path, opath, itype, otype, key)
+			}
+			if err != nil {
+				log.Println(path, err)
+				c.Failed++
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close checks the references between the sheets converted or up to date,
+// saves the string tables without the strings of deleted inputs, prunes
+// outputs of deleted inputs and saves the manifests.
+func (c *Converter) Close() {
+	if !c.DryRun {
+		for _, msg := range _refs.Check() {
+			log.Println(msg)
+			c.Failed++
+		}
+		for _, m := range c.manifests {
+			for _, e := range m.Stale() {
+				for _, l := range _localizers {
+					l.Drop(tableName(e.Input))
+				}
+			}
+		}
+		for _, l := range _localizers {
+			if err := l.Save(); err != nil {
+				log.Println(l.Dir, err)
+				c.Failed++
+			}
+		}
+	}
+
+	for _, m := range c.manifests {
+		if c.DryRun {
+			for output, e := range m.Stale() {
+				fmt.Println("remove   ", output, "input", e.Input, "deleted")
+			}
+			continue
+		}
+		m.Prune()
+		if err := m.Save(); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -1,43 +1,213 @@
 package main
 
 import (
+	"bytes"
 	"encoding/csv"
 	"errors"
+	"flag"
 	"os"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 type CsvHelper struct {
 	name string
 }
 
+// The csv dialect: the separator, auto to guess it from the first line, the
+// prefix of comment lines, the encoding, auto to detect utf-8, utf-16 and
+// gb18030 (a superset of gbk), whether quotes may appear in unquoted
+// fields, and whether the written files start with a utf-8 BOM so that
+// excel reads them as utf-8. A BOM of the inputs is always stripped.
+var _csvSep string = ","
+var _csvComment string = ""
+var _csvEncoding string = "auto"
+var _csvLazyQuotes bool = false
+var _csvBOM bool = false
+
+var csvEncodings = map[string]bool{"auto": true, "utf8": true, "gbk": true, "gb18030": true, "utf16le": true, "utf16be": true}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// SetCsvDialect sets the csv dialect, sep is a character, tab or auto.
+func SetCsvDialect(sep, comment, encoding string, lazyQuotes, bom bool) error {
+	if sep == "tab" || sep == "\\t" {
+		sep = "\t"
+	}
+	if sep != "auto" && utf8.RuneCountInString(sep) != 1 || sep == "\"" || sep == "\n" || sep == "\r" {
+		return errors.New("invalid csv separator " + sep + ", expect one character, tab or auto")
+	}
+	if utf8.RuneCountInString(comment) > 1 || comment == sep {
+		return errors.New("invalid csv comment " + comment + ", expect one character other than the separator")
+	}
+	if !csvEncodings[encoding] {
+		return errors.New("unknown csv encoding " + encoding + ", expect auto, utf8, gbk, gb18030, utf16le or utf16be")
+	}
+	_csvSep, _csvComment, _csvEncoding, _csvLazyQuotes, _csvBOM = sep, comment, encoding, lazyQuotes, bom
+	return nil
+}
+
+// csvFlags adds the csv dialect flags to fs, the returned function sets the
+// dialect once fs is parsed.
+func csvFlags(fs *flag.FlagSet) func() error {
+	sep := fs.String("csvsep", ",", "-csvsep separator of csv files, one character, tab or auto")
+	comment := fs.String("csvcomment", "", "-csvcomment character starting the comment lines of csv files")
+	encoding := fs.String("csvenc", "auto", "-csvenc encoding of csv inputs: auto, utf8, gbk, gb18030, utf16le or utf16be")
+	lazy := fs.Bool("csvlazy", false, "-csvlazy allow quotes in unquoted fields of csv inputs")
+	bom := fs.Bool("csvbom", false, "-csvbom start csv outputs with a utf-8 BOM for excel")
+	return func() error {
+		return SetCsvDialect(*sep, *comment, *encoding, *lazy, *bom)
+	}
+}
+
+// decodeText returns b as utf-8 without BOM.
+func decodeText(b []byte, encoding string) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, utf8BOM):
+		return b[len(utf8BOM):], nil
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		return decodeUTF16(b[2:], false)
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		return decodeUTF16(b[2:], true)
+	}
+
+	if encoding == "auto" {
+		switch {
+		case isUTF16(b, false):
+			encoding = "utf16le"
+		case isUTF16(b, true):
+			encoding = "utf16be"
+		case utf8.Valid(b):
+			encoding = "utf8"
+		default:
+			encoding = "gb18030"
+		}
+	}
+	switch encoding {
+	case "utf16le":
+		return decodeUTF16(b, false)
+	case "utf16be":
+		return decodeUTF16(b, true)
+	case "gbk", "gb18030":
+		return simplifiedchinese.GB18030.NewDecoder().Bytes(b)
+	default:
+		return b, nil
+	}
+}
+
+// isUTF16 guesses whether b is utf-16 without BOM: text of csv files is
+// mostly ascii, whose high bytes are zero.
+func isUTF16(b []byte, bigEndian bool) bool {
+	pairs, zeros := 0, 0
+	for i := 0; i+1 < len(b) && pairs < 512; i += 2 {
+		pairs++
+		high := b[i+1]
+		if bigEndian {
+			high = b[i]
+		}
+		if high == 0 {
+			zeros++
+		}
+	}
+	return pairs > 0 && zeros*2 > pairs
+}
+
+func decodeUTF16(b []byte, bigEndian bool) ([]byte, error) {
+	if len(b)%2 != 0 {
+		return nil, errors.New("invalid utf-16 text of odd length")
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			units[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return []byte(string(utf16.Decode(units))), nil
+}
+
+// csvSep returns the separator of text, guessed from the separators
+// outside quotes in its first line when auto.
+func csvSep(text []byte) rune {
+	if _csvSep != "auto" {
+		r, _ := utf8.DecodeRuneInString(_csvSep)
+		return r
+	}
+	line := string(text)
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	counts := map[rune]int{}
+	quoted := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ',' || r == ';' || r == '\t' || r == '|'):
+			counts[r]++
+		}
+	}
+	sep := ','
+	for _, r := range []rune{';', '\t', '|'} {
+		if counts[r] > counts[sep] {
+			sep = r
+		}
+	}
+	return sep
+}
+
 func NewCsvHelper(name string) (Helper, error) {
 	x := &CsvHelper{name: name}
 	return x, nil
 }
 
 func (x *CsvHelper) ReadArray() ([][]string, error) {
-	if fd, err := os.OpenFile(x.name, os.O_RDONLY, os.ModePerm); err == nil {
-		defer fd.Close()
-		return csv.NewReader(fd).ReadAll()
-	} else {
+	b, err := os.ReadFile(x.name)
+	if err != nil {
 		return nil, err
 	}
+	text, err := decodeText(b, _csvEncoding)
+	if err != nil {
+		return nil, errors.New(x.name + ": " + err.Error())
+	}
+
+	r := csv.NewReader(bytes.NewReader(text))
+	r.Comma = csvSep(text)
+	if _csvComment != "" {
+		r.Comment, _ = utf8.DecodeRuneInString(_csvComment)
+	}
+	r.LazyQuotes = _csvLazyQuotes
+	return r.ReadAll()
 }
 
 func (x *CsvHelper) WriteArray(values [][]string) error {
-	fd, err := os.OpenFile(x.name, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	fd, err := os.OpenFile(x.name, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		return err
 	}
 	defer fd.Close()
-	return csv.NewWriter(fd).WriteAll(values)
+	if _csvBOM {
+		if _, err := fd.Write(utf8BOM); err != nil {
+			return err
+		}
+	}
+	w := csv.NewWriter(fd)
+	if _csvSep != "auto" {
+		w.Comma, _ = utf8.DecodeRuneInString(_csvSep)
+	}
+	return w.WriteAll(values)
 }
 
 func (x *CsvHelper) ReadMap(key string) (interface{}, error) {
-	values, err := x.ReadArray()
+	values, err := readSheet(x)
 	if err != nil {
 		return nil, err
 	}
+	values = untypedSide(values)
 
 	header := map[string]int{}
 	for k, v := range values[0] {
@@ -45,16 +215,20 @@ func (x *CsvHelper) ReadMap(key string) (interface{}, error) {
 	}
 
 	if kindex, exist := header[key]; exist {
+		if v := checkKeys(values, dataRow(), kindex, key, ""); len(v) > 0 {
+			return nil, violationsError(v)
+		}
+
 		result := make(map[string]map[string]interface{})
-		for i := 1; i < len(values[1:]); i++ {
-			kval := values[i][kindex]
-			result[kval] = make(map[string]interface{})
-
-			for j := 0; j < len(values[i]); j++ {
-				if j != kindex {
-					result[kval][values[0][j]] = values[i][j]
-				}
+		for i := dataRow(); i < len(values); i++ {
+			if isBlank(values[i]) {
+				continue
+			}
+			row, err := rowMap(values[0], values[i], i, kindex)
+			if err != nil {
+				return nil, err
 			}
+			result[values[i][kindex]] = row
 		}
 		return result, nil
 	} else {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time columns:
+//
+//	Start_DATE  2024-05-01 10:00   a date or datetime, written as a unix timestamp or ISO 8601
+//	CD_DUR      1h30m              a duration, written as seconds
+//
+// dates without a zone are in the zone set by SetTimeOptions.
+
+var _timeFormat string = "unix"
+var _timeZone *time.Location = time.Local
+
+// SetTimeOptions sets how dates are written, "unix" or "iso", and the zone
+// of dates given without one, a tz database name or Local.
+func SetTimeOptions(format, zone string) error {
+	if format == "" {
+		format = "unix"
+	}
+	if format != "unix" && format != "iso" {
+		return errors.New("unknown time format " + format + ", expect unix or iso")
+	}
+	if zone == "" {
+		zone = "Local"
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return err
+	}
+	_timeFormat, _timeZone = format, loc
+	return nil
+}
+
+var dateLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"2006/01/02",
+}
+
+// parseDate parses an ISO 8601 date or datetime, or a number: an excel
+// serial date below 1000000, a unix timestamp otherwise.
+func parseDate(cell string) (time.Time, error) {
+	cell = strings.TrimSpace(cell)
+	if t, err := time.Parse(time.RFC3339, cell); err == nil {
+		return t, nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, cell, _timeZone); err == nil {
+			return t, nil
+		}
+	}
+	if f, err := strconv.ParseFloat(cell, 64); err == nil {
+		if math.Abs(f) < 1000000 {
+			return excelTime(f, false, _timeZone), nil
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Time{}, errors.New("invalid date " + strconv.Quote(cell))
+}
+
+// excelTime converts an excel serial date to a time in loc.
+func excelTime(f float64, date1904 bool, loc *time.Location) time.Time {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, loc)
+	if date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, loc)
+	}
+	days := math.Floor(f)
+	t := epoch.AddDate(0, 0, int(days))
+	return t.Add(time.Duration(math.Round((f-days)*86400)) * time.Second)
+}
+
+// dateValue returns a date as a unix timestamp or ISO 8601 text.
+func dateValue(cell string) (interface{}, error) {
+	t, err := parseDate(cell)
+	if err != nil {
+		return nil, err
+	}
+	if _timeFormat == "iso" {
+		return t.In(_timeZone).Format(time.RFC3339), nil
+	}
+	return t.Unix(), nil
+}
+
+var clockDuration = regexp.MustCompile(`^(\d+):(\d{1,2})(?::(\d{1,2}(?:\.\d+)?))?$`)
+
+// parseDuration parses 1h30m (d for days is accepted too), 1:30:00 or a
+// number of seconds.
+func parseDuration(cell string) (time.Duration, error) {
+	cell = strings.TrimSpace(cell)
+	if f, err := strconv.ParseFloat(cell, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if m := clockDuration.FindStringSubmatch(cell); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		min, _ := strconv.Atoi(m[2])
+		sec := 0.0
+		if m[3] != "" {
+			sec, _ = strconv.ParseFloat(m[3], 64)
+		}
+		return time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+	}
+
+	var days time.Duration
+	if i := strings.Index(cell, "d"); i > 0 {
+		n, err := strconv.Atoi(cell[:i])
+		if err != nil {
+			return 0, errors.New("invalid duration " + strconv.Quote(cell))
+		}
+		days, cell = time.Duration(n)*24*time.Hour, cell[i+1:]
+		if cell == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(cell)
+	if err != nil {
+		return 0, errors.New("invalid duration " + strconv.Quote(cell))
+	}
+	return days + d, nil
+}
+
+// durationValue returns a duration as seconds.
+func durationValue(cell string) (interface{}, error) {
+	d, err := parseDuration(cell)
+	if err != nil {
+		return nil, err
+	}
+	return luaNumber(d.Seconds()), nil
+}
+
+// timeNumber returns the seconds of a DATE or DUR cell, what min and max
+// constraints compare.
+func timeNumber(cell string, col column) (float64, error) {
+	switch col.Type {
+	case "DATE":
+		t, err := parseDate(cell)
+		return float64(t.Unix()), err
+	default:
+		d, err := parseDuration(cell)
+		return d.Seconds(), err
+	}
+}
+
+// isDateFormat reports whether an excel number format shows a date or time,
+// and whether it shows elapsed time like [h]:mm.
+func isDateFormat(format string) (bool, bool) {
+	date, elapsed := false, false
+	for i := 0; i < len(format); i++ {
+		switch format[i] {
+		case '"':
+			if j := strings.IndexByte(format[i+1:], '"'); j != -1 {
+				i += j + 1
+			}
+		case '\\', '_', '*':
+			i++
+		case '[':
+			j := strings.IndexByte(format[i:], ']')
+			if j == -1 {
+				return date, elapsed
+			}
+			if strings.Trim(strings.ToLower(format[i+1:i+j]), "hms") == "" {
+				date, elapsed = true, true
+			}
+			i += j
+		case 'y', 'Y', 'd', 'D', 'h', 'H', 's', 'S', 'm', 'M':
+			date = true
+		}
+	}
+	return date, elapsed
+}
+
+// excelCellText returns the text of a cell holding the serial number value
+// shown with format, dates as ISO 8601 and elapsed or day times as h:mm:ss,
+// false when the format shows no date.
+func excelCellText(value, format string, date1904 bool) (string, bool) {
+	date, elapsed := isDateFormat(format)
+	if !date {
+		return "", false
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+	if elapsed || f >= 0 && f < 1 {
+		sec := int64(math.Round(f * 86400))
+		return strconv.FormatInt(sec/3600, 10) + ":" + twoDigits(sec/60%60) + ":" + twoDigits(sec%60), true
+	}
+	t := excelTime(f, date1904, time.UTC)
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02"), true
+	}
+	return t.Format("2006-01-02T15:04:05"), true
+}
+
+func twoDigits(n int64) string {
+	if n < 10 {
+		return "0" + strconv.FormatInt(n, 10)
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+)
+
+// the policies for empty cells:
+//
+//	omit     the field is left out, nil in lua
+//	default  the zero value of the column type: 0, false, "", {}
+//	null     the field is written as null in json and nil in lua
+//	error    an empty cell is reported like a required one
+var emptyPolicies = map[string]bool{"omit": true, "default": true, "null": true, "error": true}
+
+var _emptyPolicy string = "omit"
+
+// SetEmptyPolicy sets the policy of columns not declaring one.
+func SetEmptyPolicy(policy string) error {
+	if policy == "" {
+		policy = "omit"
+	}
+	if !emptyPolicies[policy] {
+		return errors.New("unknown empty policy " + policy + ", expect omit, default, null or error")
+	}
+	_emptyPolicy = policy
+	return nil
+}
+
+// emptyPolicy returns the policy for the empty cells of the column.
+func (c *Constraint) emptyPolicy() string {
+	if c != nil && c.Empty != "" {
+		return c.Empty
+	}
+	return _emptyPolicy
+}
+
+// required reports whether an empty cell of the column is an error.
+func (c *Constraint) required() bool {
+	return c.Required || c.emptyPolicy() == "error"
+}
+
+// zeroValue returns the default value of the type of col, false when the
+// type has none.
+func (col column) zeroValue() (interface{}, bool) {
+	if len(col.Path) > 0 {
+		if _, ok := col.Path[0].(int); ok {
+			return []interface{}{}, true
+		}
+		return map[string]interface{}{}, true
+	}
+	switch col.Type {
+	case "AN", "AS", "AB", "AAN", "AAS", "AAB":
+		return []interface{}{}, true
+	case "N", "DUR":
+		return int64(0), true
+	case "B":
+		return false, true
+	case "S":
+		return "", true
+	default:
+		return nil, false
+	}
+}
+
+// emptyValue returns the value of a field whose cells are all empty, false
+// when the field is left out.
+func (t *TableConfig) emptyValue(col column) (interface{}, bool) {
+	switch t.constraints[col.Name].emptyPolicy() {
+	case "null":
+		return nil, true
+	case "default":
+		return col.zeroValue()
+	default:
+		return nil, false
+	}
+}
+
+// emptyCell returns the value of an empty cell of a sheet without type
+// declarations, false when the field is left out.
+func emptyCell(row, col int, name string) (interface{}, bool, error) {
+	switch _emptyPolicy {
+	case "null":
+		return nil, true, nil
+	case "default":
+		return "", true, nil
+	case "error":
+		return nil, false, errors.New(cellName(row, col) + " " + name + ": empty")
+	default:
+		return nil, false, nil
+	}
+}
+
+// rowMap returns the fields of row i of a sheet without type declarations
+// besides the key column.
+func rowMap(header, row []string, i, kindex int) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	for j, name := range header {
+		if j == kindex || name == "" {
+			continue
+		}
+		if cell := cellOf(row, j); cell != "" {
+			result[name] = cell
+			continue
+		}
+		v, ok, err := emptyCell(i, j, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result[name] = v
+		}
+	}
+	return result, nil
+}
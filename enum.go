@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// _enums maps enum name to constant name to value, columns declared with
+// @Enum.Name translate the constant names in their cells to the values.
+var _enums = map[string]map[string]string{}
+var _enumFiles []string
+
+// enumsFromArray reads a sheet with the columns Enum, Name and Value.
+func enumsFromArray(data [][]string) error {
+	if len(data) == 0 {
+		return errors.New("empty sheet")
+	}
+
+	index := map[string]int{"Enum": -1, "Name": -1, "Value": -1}
+	for i, h := range data[0] {
+		if _, ok := index[h]; ok {
+			index[h] = i
+		}
+	}
+	for h, i := range index {
+		if i == -1 {
+			return errors.New("enum sheet has no column " + h)
+		}
+	}
+
+	for i := 1; i < len(data); i++ {
+		enum, name, value := cellOf(data[i], index["Enum"]), cellOf(data[i], index["Name"]), cellOf(data[i], index["Value"])
+		if enum == "" && name == "" {
+			continue
+		}
+		if err := addEnum(enum, name, value); err != nil {
+			return errors.New(cellName(i, index["Name"]) + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+// enumsFromMap reads a table like {Element = {Fire = 3, Water = 4}}.
+func enumsFromMap(value interface{}) error {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("enums must be a table of tables")
+	}
+	for enum, v := range m {
+		constants, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("enum " + enum + " must be a table")
+		}
+		for name, value := range constants {
+			if err := addEnum(enum, name, fmt.Sprint(value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func addEnum(enum, name, value string) error {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return errors.New("enum " + enum + "." + name + " value " + strconv.Quote(value) + " is not a number")
+	}
+	if _enums[enum] == nil {
+		_enums[enum] = map[string]string{}
+	}
+	if old, ok := _enums[enum][name]; ok && old != value {
+		return errors.New("enum " + enum + "." + name + " defined twice")
+	}
+	_enums[enum][name] = refValue(value)
+	return nil
+}
+
+// LoadEnums reads the enum definitions from sheets with the columns Enum,
+// Name and Value, or from lua/json files defining a table of enums.
+func LoadEnums(paths []string) error {
+	_enums = map[string]map[string]string{}
+	_enumFiles = paths
+
+	for _, path := range paths {
+		h, err := openInput(path, "")
+		if err != nil {
+			return err
+		}
+
+		if t := fileType(path); t == "lua" || t == "json" {
+			value, err := h.ReadMap("")
+			if err == nil {
+				err = enumsFromMap(value)
+			}
+			if err != nil {
+				return errors.New(path + ": " + err.Error())
+			}
+			continue
+		}
+
+		data, err := h.ReadArray()
+		if err == nil {
+			err = enumsFromArray(data)
+		}
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value.
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// enumValue translates a constant name of enum, values of the enum are accepted as is.
+func enumValue(enum, cell string) (string, error) {
+	constants, ok := _enums[enum]
+	if !ok {
+		return "", errors.New("unknown enum " + enum)
+	}
+	if v, ok := constants[cell]; ok {
+		return v, nil
+	}
+	for _, v := range constants {
+		if v == refValue(cell) {
+			return v, nil
+		}
+	}
+	return "", errors.New(strconv.Quote(cell) + " not in enum " + enum)
+}
+
+// enumName translates a value of enum back to its constant name.
+func enumName(enum, value string) (string, bool) {
+	for name, v := range _enums[enum] {
+		if v == refValue(value) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Enum returns the enum the column is declared with, or "".
+func (c *column) Enum() string {
+	if table, field := splitRef(c.Ref); table == "Enum" {
+		return field
+	}
+	return ""
+}
+
+// restoreHeader puts back the declarations of header, the header of the
+// sheet about to be overwritten, on the columns of data with the same name
+// and translates enum values back to their constant names.
+func restoreHeader(data [][]string, header []string) [][]string {
+	t := &TableConfig{}
+	if len(data) == 0 || t.init(header) != nil {
+		return data
+	}
+	data = collapseColumns(data, header)
+
+	for i, h := range data[0] {
+		cols, ok := t.cols[h]
+		if !ok || len(cols[0].Path) > 0 {
+			continue
+		}
+		data[0][i] = header[cols[0].Index]
+
+		enum := cols[0].Enum()
+		if enum == "" {
+			continue
+		}
+		for j := 1; j < len(data); j++ {
+			if name, ok := enumName(enum, cellOf(data[j], i)); ok {
+				data[j][i] = name
+			}
+		}
+	}
+	return data
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var _luaLongStrings bool = false
+
+// SetLuaLongStrings writes multi-line strings to lua as long brackets [[...]].
+func SetLuaLongStrings(b bool) {
+	_luaLongStrings = b
+}
+
+// jsonQuote returns s as a json string as specified by RFC 8259, invalid
+// UTF-8 is replaced by U+FFFD.
+func jsonQuote(s string) string {
+	buf := bytes.NewBufferString("\"")
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\b':
+			buf.WriteString("\\b")
+		case '\f':
+			buf.WriteString("\\f")
+		case '\u2028', '\u2029':
+			// valid json, but not inside javascript strings
+			fmt.Fprintf(buf, "\\u%04x", r)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, "\\u%04x", r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteString("\"")
+	return buf.String()
+}
+
+// luaQuote returns s as a quoted lua string, control characters are written
+// as escape sequences lua 5.1 understands.
+func luaQuote(s string) string {
+	buf := bytes.NewBufferString("\"")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		default:
+			if c < 0x20 || c == 0x7f {
+				// a following digit would be read as part of a shorter escape
+				fmt.Fprintf(buf, "\\%03d", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteString("\"")
+	return buf.String()
+}
+
+// luaString returns s as a lua string, multi-line text is written as a
+// long bracket string when enabled.
+func luaString(s string) string {
+	if !_luaLongStrings || !strings.Contains(s, "\n") || strings.ContainsAny(s, "\r\x00") {
+		return luaQuote(s)
+	}
+
+	// choose a level whose closing bracket does not appear in s
+	level := ""
+	for strings.Contains(s+"]", "]"+level+"]") {
+		level += "="
+	}
+	// lua skips a newline right after the opening bracket
+	if strings.HasPrefix(s, "\n") {
+		s = "\n" + s
+	}
+	return "[" + level + "[" + s + "]" + level + "]"
+}
+
+// luaNumeral matches the decimal numbers lua reads as such, unlike
+// strconv.ParseFloat it rejects NaN, Inf and +5.
+var luaNumeral = regexp.MustCompile(`^-?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// luaCell returns the text of a sheet cell as a lua value. Numbers,
+// booleans and tables of constants, like the {1,2,k="v",} LValueToString
+// writes, are kept as they are, any other text is written as a string.
+func luaCell(cell string) string {
+	if cell == "true" || cell == "false" || luaNumeral.MatchString(cell) || isLuaTable(cell) {
+		return cell
+	}
+	return luaString(cell)
+}
+
+// isLuaTable reports whether cell is a table constructor holding nothing but
+// constants, so that no sheet text is written as lua code.
+func isLuaTable(cell string) bool {
+	if !strings.HasPrefix(cell, "{") || !strings.HasSuffix(cell, "}") {
+		return false
+	}
+	chunk, err := parse.Parse(strings.NewReader("return "+cell), "cell")
+	if err != nil || len(chunk) != 1 {
+		return false
+	}
+	ret, ok := chunk[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Exprs) != 1 {
+		return false
+	}
+	_, ok = ret.Exprs[0].(*ast.TableExpr)
+	return ok && isLuaConstant(ret.Exprs[0])
+}
+
+func isLuaConstant(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.NumberExpr, *ast.StringExpr, *ast.TrueExpr, *ast.FalseExpr, *ast.NilExpr:
+		return true
+	case *ast.UnaryMinusOpExpr:
+		_, ok := e.Expr.(*ast.NumberExpr)
+		return ok
+	case *ast.TableExpr:
+		for _, f := range e.Fields {
+			if f.Key != nil && !isLuaConstant(f.Key) || !isLuaConstant(f.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
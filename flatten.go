@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Nested json and lua rows are written to sheets as path columns, a name
+// followed by array indices and table fields and ending with the type:
+//
+//	Reward[1].Id_N  Reward[1].Count_N  Reward[2].Id_N  Title.en_S  Tags[1]_S
+//
+// the cells of a path column build the row again on the way back.
+
+var pathSegment = regexp.MustCompile(`\[(\d+)\]|\.([^.\[\]@]+)`)
+
+var pathName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// isPath reports whether c is a path column.
+func (c column) isPath() bool {
+	return len(c.Path) > 0 && strings.Contains("LSNB", c.Type)
+}
+
+// parsePath parses the indices and fields of a path column.
+func parsePath(segments string) ([]interface{}, error) {
+	var path []interface{}
+	for _, m := range pathSegment.FindAllStringSubmatch(segments, -1) {
+		if m[1] == "" {
+			path = append(path, m[2])
+			continue
+		}
+		idx, err := strconv.Atoi(m[1])
+		if err != nil || idx < 1 {
+			return nil, errors.New("array index " + m[1] + " must start from 1")
+		}
+		path = append(path, idx)
+	}
+	return path, nil
+}
+
+// isNested reports whether a row of rows holds a table.
+func isNested(rows interface{}) bool {
+	nested := false
+	eachRow(rows, func(key string, row map[string]interface{}) {
+		for _, v := range row {
+			switch v.(type) {
+			case []interface{}, map[string]interface{}, StringKeyed, *LuaTable:
+				nested = true
+			}
+		}
+	})
+	return nested
+}
+
+// eachRow calls f with the rows of an array or map of rows, key is empty for arrays.
+func eachRow(rows interface{}, f func(key string, row map[string]interface{})) {
+	asRow := func(v interface{}) map[string]interface{} {
+		switch row := v.(type) {
+		case map[string]interface{}:
+			return row
+		case StringKeyed:
+			return row
+		}
+		return nil
+	}
+	switch rows := rows.(type) {
+	case []interface{}:
+		for _, v := range rows {
+			f("", asRow(v))
+		}
+	case map[string]interface{}:
+		for k, v := range rows {
+			f(k, asRow(v))
+		}
+	case StringKeyed:
+		for k, v := range rows {
+			f(k, asRow(v))
+		}
+	}
+}
+
+// flattenValue adds the cells of v to cells, name is the column of v without type.
+func flattenValue(name string, v interface{}, cells map[string]string) error {
+	switch v := v.(type) {
+	case nil:
+	case []interface{}:
+		for i, e := range v {
+			if err := flattenValue(name+"["+strconv.Itoa(i+1)+"]", e, cells); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if k == "" || strings.ContainsAny(k, ".[]@") {
+				return errors.New("field " + strconv.Quote(k) + " of " + name + " can not be a column")
+			}
+			if err := flattenValue(name+"."+k, e, cells); err != nil {
+				return err
+			}
+		}
+	case StringKeyed:
+		return flattenValue(name, map[string]interface{}(v), cells)
+	case *LuaTable:
+		if err := flattenValue(name, v.Array, cells); err != nil {
+			return err
+		}
+		return flattenValue(name, v.Hash, cells)
+	case string:
+		cells[name+"_S"] = v
+	case bool:
+		cells[name+"_B"] = strconv.FormatBool(v)
+	case LuaCode:
+		cells[name+"_L"] = string(v)
+	case json.Number, int64, float64:
+		cells[name+"_N"] = formatNumber(v)
+	default:
+		return errors.New(name + " has a value of unsupported type")
+	}
+	return nil
+}
+
+// splitColumn returns the name and path of a path column header.
+func splitColumn(h string) (string, []interface{}) {
+	h = h[:len(h)-2]
+	i := strings.IndexAny(h, "[.")
+	if i == -1 {
+		return h, nil
+	}
+	path, _ := parsePath(h[i:])
+	return h[:i], path
+}
+
+// columnOrder orders path columns by name, then indices numerically and
+// fields alphabetically, indices first.
+func columnOrder(a, b string) bool {
+	na, pa := splitColumn(a)
+	nb, pb := splitColumn(b)
+	if na != nb {
+		return na < nb
+	}
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ia, aint := pa[i].(int)
+		ib, bint := pb[i].(int)
+		switch {
+		case aint != bint:
+			return aint
+		case aint && ia != ib:
+			return ia < ib
+		case !aint && pa[i] != pb[i]:
+			return pa[i].(string) < pb[i].(string)
+		}
+	}
+	if len(pa) != len(pb) {
+		return len(pa) < len(pb)
+	}
+	return a < b
+}
+
+// flatten writes rows holding tables to a sheet with path columns, map rows
+// get a key column, ID_KN when every key is a number and ID_KS otherwise.
+func flatten(rows interface{}) ([][]string, error) {
+	var keys []string
+	var cells []map[string]string
+	types := map[string]string{}
+	names := map[string]bool{}
+	var err error
+	eachRow(rows, func(key string, row map[string]interface{}) {
+		if err != nil {
+			return
+		}
+		if row == nil {
+			err = errors.New("not support json format")
+			return
+		}
+		c := map[string]string{}
+		for name, v := range row {
+			if !pathName.MatchString(name) {
+				err = errors.New("field " + strconv.Quote(name) + " can not be a column")
+				return
+			}
+			names[name] = true
+			if err = flattenValue(name, v, c); err != nil {
+				return
+			}
+		}
+		for h := range c {
+			p, t := h[:len(h)-2], h[len(h)-1:]
+			if old, ok := types[p]; ok && old != t {
+				err = errors.New(p + " has values of different types")
+				return
+			}
+			types[p] = t
+		}
+		keys = append(keys, key)
+		cells = append(cells, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var header []string
+	for p, t := range types {
+		header = append(header, p+"_"+t)
+	}
+	sort.Slice(header, func(i, j int) bool { return columnOrder(header[i], header[j]) })
+
+	_, keyed := rows.(map[string]interface{})
+	_, strkeys := rows.(StringKeyed)
+	if keyed || strkeys {
+		kname := "ID"
+		for i := 2; names[kname]; i++ {
+			kname = "ID" + strconv.Itoa(i)
+		}
+		ktype := "N"
+		for _, k := range keys {
+			if strkeys || !isNumberKey(k) {
+				ktype = "S"
+			}
+		}
+		header = append([]string{kname + "_K" + ktype}, header...)
+
+		order := make([]int, len(keys))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			ki, kj := keys[order[i]], keys[order[j]]
+			if ktype == "N" {
+				fi, _ := strconv.ParseFloat(ki, 64)
+				fj, _ := strconv.ParseFloat(kj, 64)
+				return fi < fj
+			}
+			return ki < kj
+		})
+		sorted := make([]map[string]string, len(keys))
+		for i, o := range order {
+			sorted[i] = cells[o]
+			sorted[i][header[0]] = keys[o]
+		}
+		cells = sorted
+	}
+
+	data := [][]string{header}
+	for _, c := range cells {
+		row := make([]string, len(header))
+		for j, h := range header {
+			row[j] = c[h]
+		}
+		data = append(data, row)
+	}
+	return data, nil
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Formula cells of xlsx read their cached value, what excel showed when it
+// saved the file, or with the eval policy the value of the formula as far
+// as it is simple enough:
+//
+//	numbers, + - * / ^ %, parentheses
+//	B2, $B$2, Sheet2!B2, 'Base Stats'!B2 and ranges like B2:D5 in functions
+//	SUM MIN MAX AVERAGE COUNT ABS ROUND ROUNDUP ROUNDDOWN INT POWER SQRT
+//
+// other formulas read their cached value.
+var formulaPolicies = map[string]bool{"cached": true, "eval": true}
+
+var _formulaPolicy string = "cached"
+
+// SetFormulaPolicy sets how formula cells are read, cached or eval.
+func SetFormulaPolicy(policy string) error {
+	if policy == "" {
+		policy = "cached"
+	}
+	if !formulaPolicies[policy] {
+		return errors.New("unknown formula policy " + policy + ", expect cached or eval")
+	}
+	_formulaPolicy = policy
+	return nil
+}
+
+// excelNumber returns the text of a formula result rounded to the 15
+// significant digits excel keeps, so 0.1+0.2 reads 0.3.
+func excelNumber(f float64) string {
+	f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', 15, 64), 64)
+	return formatNumber(luaNumber(f))
+}
+
+// formulaValue returns the value of the formula cell at row i and column j
+// of s and whether it was evaluated.
+func (x *XlsxHelper) formulaValue(s *xlsx.Sheet, c *xlsx.Cell, i, j int, formula string) (string, bool) {
+	where := x.name + " " + s.Name + " " + cellName(i, j)
+	var err error
+	if _formulaPolicy == "eval" {
+		if x.eval == nil {
+			x.eval = &formulaEval{file: x.file, values: map[string]float64{}, busy: map[string]bool{}}
+		}
+		var f float64
+		if f, err = x.eval.cell(s, i, j); err == nil {
+			value := excelNumber(f)
+			if cached, err := strconv.ParseFloat(c.Value, 64); err == nil && excelNumber(cached) != value {
+				log.Println(where, "formula", formula, "evaluates to", value, "but the cached value is", c.Value)
+			}
+			return value, true
+		}
+	}
+	if c.Value == "" && err != nil {
+		log.Println(where, "formula", formula, "has no cached value and is not evaluated:", err)
+	} else if c.Value == "" {
+		log.Println(where, "formula", formula, "has no cached value, save the file in excel")
+	}
+	return c.Value, false
+}
+
+// formulaEval evaluates the formulas of a workbook, values holds the cells
+// already evaluated and busy those being evaluated.
+type formulaEval struct {
+	file   *xlsx.File
+	values map[string]float64
+	busy   map[string]bool
+}
+
+func (e *formulaEval) cell(s *xlsx.Sheet, i, j int) (float64, error) {
+	name := s.Name + "!" + cellName(i, j)
+	if v, ok := e.values[name]; ok {
+		return v, nil
+	}
+	if e.busy[name] {
+		return 0, errors.New("circular reference " + name)
+	}
+
+	c := sheetCell(s, i, j)
+	if c == nil {
+		return 0, nil
+	}
+
+	formula := strings.TrimPrefix(c.Formula(), "=")
+	if formula == "" {
+		text := strings.TrimSpace(c.Value)
+		if text == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, errors.New(name + " is not a number")
+		}
+		return f, nil
+	}
+
+	e.busy[name] = true
+	defer delete(e.busy, name)
+	p := &formulaParser{eval: e, sheet: s, text: formula}
+	v, err := p.parse()
+	if err != nil {
+		return 0, err
+	}
+	e.values[name] = v
+	return v, nil
+}
+
+// isNumber reports whether the text of a cell is a number, not empty or text.
+func isNumber(text string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	return err == nil
+}
+
+func sheetCell(s *xlsx.Sheet, i, j int) *xlsx.Cell {
+	if i < len(s.Rows) && s.Rows[i] != nil && j < len(s.Rows[i].Cells) {
+		return s.Rows[i].Cells[j]
+	}
+	return nil
+}
+
+// formulaParser parses and evaluates one formula by recursive descent.
+type formulaParser struct {
+	eval  *formulaEval
+	sheet *xlsx.Sheet
+	text  string
+	pos   int
+}
+
+func (p *formulaParser) parse() (float64, error) {
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return 0, fmt.Errorf("unsupported %q at %d", p.text[p.pos:], p.pos+1)
+	}
+	return v, nil
+}
+
+func (p *formulaParser) skipSpace() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// next skips spaces and reports whether the text continues with one of ops.
+func (p *formulaParser) next(ops string) (byte, bool) {
+	p.skipSpace()
+	if p.pos < len(p.text) && strings.IndexByte(ops, p.text[p.pos]) != -1 {
+		p.pos++
+		return p.text[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *formulaParser) expr() (float64, error) {
+	v, err := p.term()
+	for err == nil {
+		op, ok := p.next("+-")
+		if !ok {
+			break
+		}
+		var w float64
+		if w, err = p.term(); op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+	return v, err
+}
+
+func (p *formulaParser) term() (float64, error) {
+	v, err := p.power()
+	for err == nil {
+		op, ok := p.next("*/")
+		if !ok {
+			break
+		}
+		var w float64
+		if w, err = p.power(); err != nil {
+			break
+		}
+		if op == '*' {
+			v *= w
+		} else if w == 0 {
+			err = errors.New("division by zero")
+		} else {
+			v /= w
+		}
+	}
+	return v, err
+}
+
+// power binds looser than negation as in excel, -2^2 is 4.
+func (p *formulaParser) power() (float64, error) {
+	v, err := p.unary()
+	for err == nil {
+		if _, ok := p.next("^"); !ok {
+			break
+		}
+		var w float64
+		w, err = p.unary()
+		v = math.Pow(v, w)
+	}
+	return v, err
+}
+
+func (p *formulaParser) unary() (float64, error) {
+	if op, ok := p.next("+-"); ok {
+		v, err := p.unary()
+		if op == '-' {
+			v = -v
+		}
+		return v, err
+	}
+	v, err := p.primary()
+	for err == nil {
+		if _, ok := p.next("%"); !ok {
+			break
+		}
+		v /= 100
+	}
+	return v, err
+}
+
+func (p *formulaParser) primary() (float64, error) {
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return 0, errors.New("unexpected end of formula")
+	}
+
+	if _, ok := p.next("("); ok {
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.next(")"); !ok {
+			return 0, errors.New("missing )")
+		}
+		return v, nil
+	}
+
+	start := p.pos
+	if c := p.text[p.pos]; c >= '0' && c <= '9' || c == '.' {
+		for p.pos < len(p.text) && strings.IndexByte("0123456789.", p.text[p.pos]) != -1 {
+			p.pos++
+		}
+		if p.pos < len(p.text) && (p.text[p.pos] == 'E' || p.text[p.pos] == 'e') {
+			p.pos++
+			if p.pos < len(p.text) && (p.text[p.pos] == '+' || p.text[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.text) && p.text[p.pos] >= '0' && p.text[p.pos] <= '9' {
+				p.pos++
+			}
+		}
+		return strconv.ParseFloat(p.text[start:p.pos], 64)
+	}
+
+	if name := p.word(); name != "" {
+		if _, ok := p.next("("); ok {
+			return p.call(strings.ToUpper(name))
+		}
+		p.pos = start
+	}
+
+	values, n, err := p.reference()
+	if err != nil {
+		return 0, err
+	}
+	if n != 1 {
+		return 0, errors.New("a range is only supported as a function argument")
+	}
+	return values[0], nil
+}
+
+// word reads a function name.
+func (p *formulaParser) word() string {
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '.' || p.pos > start && c >= '0' && c <= '9') {
+			break
+		}
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// reference reads a cell or range reference, maybe of another sheet, and
+// returns the numbers of its cells and how many cells it has. Empty and
+// text cells of ranges are ignored like excel does, a formula that cannot be
+// evaluated fails the whole formula.
+func (p *formulaParser) reference() ([]float64, int, error) {
+	sheet := p.sheet
+	start := p.pos
+	if p.pos >= len(p.text) {
+		return nil, 0, errors.New("unexpected end of formula")
+	}
+	if p.text[p.pos] == '\'' {
+		end := strings.Index(p.text[p.pos+1:], "'!")
+		if end == -1 {
+			return nil, 0, errors.New("unsupported sheet name at " + strconv.Itoa(start+1))
+		}
+		name := strings.ReplaceAll(p.text[p.pos+1:p.pos+1+end], "''", "'")
+		p.pos += end + 3
+		if sheet = p.eval.file.Sheet[name]; sheet == nil {
+			return nil, 0, errors.New("no sheet " + name)
+		}
+	} else if end := strings.IndexByte(p.text[p.pos:], '!'); end > 0 && !strings.ContainsAny(p.text[p.pos:p.pos+end], "()+-*/^,:% ") {
+		name := p.text[p.pos : p.pos+end]
+		p.pos += end + 1
+		if sheet = p.eval.file.Sheet[name]; sheet == nil {
+			return nil, 0, errors.New("no sheet " + name)
+		}
+	}
+
+	r1, c1, ok := p.cellRef()
+	if !ok {
+		p.pos = start
+		return nil, 0, fmt.Errorf("unsupported %q at %d", p.text[p.pos:], p.pos+1)
+	}
+	r2, c2 := r1, c1
+	if p.pos < len(p.text) && p.text[p.pos] == ':' {
+		p.pos++
+		if r2, c2, ok = p.cellRef(); !ok {
+			return nil, 0, errors.New("unsupported range at " + strconv.Itoa(start+1))
+		}
+	}
+	if r1 > r2 {
+		r1, r2 = r2, r1
+	}
+	if c1 > c2 {
+		c1, c2 = c2, c1
+	}
+
+	if r1 == r2 && c1 == c2 {
+		v, err := p.eval.cell(sheet, r1, c1)
+		return []float64{v}, 1, err
+	}
+	var values []float64
+	for i := r1; i <= r2; i++ {
+		for j := c1; j <= c2; j++ {
+			if c := sheetCell(sheet, i, j); c == nil || c.Formula() == "" && !isNumber(c.Value) {
+				continue
+			}
+			v, err := p.eval.cell(sheet, i, j)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, v)
+		}
+	}
+	return values, (r2 - r1 + 1) * (c2 - c1 + 1), nil
+}
+
+// cellRef reads a reference like B2 or $B$2 and returns its row and column
+// indices.
+func (p *formulaParser) cellRef() (int, int, bool) {
+	start := p.pos
+	if p.pos < len(p.text) && p.text[p.pos] == '$' {
+		p.pos++
+	}
+	col := 0
+	for p.pos < len(p.text) && p.text[p.pos] >= 'A' && p.text[p.pos] <= 'Z' {
+		col = col*26 + int(p.text[p.pos]-'A'+1)
+		p.pos++
+	}
+	if p.pos < len(p.text) && p.text[p.pos] == '$' {
+		p.pos++
+	}
+	row := 0
+	digits := p.pos
+	for p.pos < len(p.text) && p.text[p.pos] >= '0' && p.text[p.pos] <= '9' {
+		row = row*10 + int(p.text[p.pos]-'0')
+		p.pos++
+	}
+	if col == 0 || p.pos == digits || row == 0 {
+		p.pos = start
+		return 0, 0, false
+	}
+	return row - 1, col - 1, true
+}
+
+// call evaluates the arguments of the function name and the function.
+func (p *formulaParser) call(name string) (float64, error) {
+	var args []float64
+	if _, ok := p.next(")"); !ok {
+		for {
+			p.skipSpace()
+			start := p.pos
+			values, _, err := p.reference()
+			if end, ok := p.next(",)"); err == nil && ok {
+				args = append(args, values...)
+				if end == ')' {
+					break
+				}
+				continue
+			}
+
+			p.pos = start
+			v, err := p.expr()
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, v)
+			end, ok := p.next(",)")
+			if !ok {
+				return 0, errors.New("missing ) of " + name)
+			}
+			if end == ')' {
+				break
+			}
+		}
+	}
+
+	want := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d arguments", name, n)
+		}
+		return nil
+	}
+	round := func(f func(float64) float64) (float64, error) {
+		if err := want(2); err != nil {
+			return 0, err
+		}
+		// round the decimal excel shows, 2.675 is 2.67499... as a float
+		scale := math.Pow(10, math.Trunc(args[1]))
+		v, _ := strconv.ParseFloat(strconv.FormatFloat(args[0]*scale, 'g', 15, 64), 64)
+		return f(v) / scale, nil
+	}
+	switch name {
+	case "SUM":
+		sum := 0.0
+		for _, v := range args {
+			sum += v
+		}
+		return sum, nil
+	case "MIN", "MAX":
+		if len(args) == 0 {
+			return 0, nil
+		}
+		v := args[0]
+		for _, w := range args[1:] {
+			if name == "MIN" {
+				v = math.Min(v, w)
+			} else {
+				v = math.Max(v, w)
+			}
+		}
+		return v, nil
+	case "AVERAGE":
+		if len(args) == 0 {
+			return 0, errors.New("AVERAGE of no numbers")
+		}
+		sum := 0.0
+		for _, v := range args {
+			sum += v
+		}
+		return sum / float64(len(args)), nil
+	case "COUNT":
+		return float64(len(args)), nil
+	case "ABS":
+		if err := want(1); err != nil {
+			return 0, err
+		}
+		return math.Abs(args[0]), nil
+	case "INT":
+		if err := want(1); err != nil {
+			return 0, err
+		}
+		return math.Floor(args[0]), nil
+	case "SQRT":
+		if err := want(1); err != nil {
+			return 0, err
+		}
+		return math.Sqrt(args[0]), nil
+	case "POWER":
+		if err := want(2); err != nil {
+			return 0, err
+		}
+		return math.Pow(args[0], args[1]), nil
+	case "ROUND":
+		return round(func(f float64) float64 { return math.Round(f) })
+	case "ROUNDUP":
+		return round(func(f float64) float64 {
+			if f < 0 {
+				return math.Floor(f)
+			}
+			return math.Ceil(f)
+		})
+	case "ROUNDDOWN":
+		return round(math.Trunc)
+	default:
+		return 0, errors.New("unsupported function " + name)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tealeg/xlsx"
+)
+
+// formulaFile returns a workbook of sheets given as rows of cells, a cell
+// like =A1+1 is a formula without cached value, =A1+1|2 one with.
+func formulaFile(sheets map[string][][]string) *xlsx.File {
+	f := xlsx.NewFile()
+	for name, rows := range sheets {
+		s := f.AddSheet(name)
+		for _, cells := range rows {
+			row := s.AddRow()
+			for _, text := range cells {
+				c := row.AddCell()
+				if strings.HasPrefix(text, "=") {
+					parts := strings.SplitN(text[1:]+"|", "|", 3)
+					c.SetFormula(parts[0])
+					text = parts[1]
+				}
+				c.Value = text
+			}
+		}
+	}
+	return f
+}
+
+// evalFormula evaluates formula in D1 of the sheet Data of a workbook with
+//
+//	Data        A: 1, 2, x, empty   B1: =A1+A2   C1: =VLOOKUP(1,A1:A2,1)|5
+//	Base        A1: 100
+//	Base Stats  A1: 7
+func evalFormula(t *testing.T, formula string) (string, bool) {
+	if err := SetFormulaPolicy("eval"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFormulaPolicy("cached")
+
+	f := formulaFile(map[string][][]string{
+		"Data": {
+			{"1", "=A1+A2", "=VLOOKUP(1,A1:A2,1)|5", "=" + formula},
+			{"2"},
+			{"x"},
+			{""},
+		},
+		"Base":       {{"100"}},
+		"Base Stats": {{"7"}},
+	})
+	x := &XlsxHelper{file: f, name: "test.xlsx"}
+	s := f.Sheet["Data"]
+	c := s.Rows[0].Cells[3]
+	return x.formulaValue(s, c, 0, 3, c.Formula())
+}
+
+func TestFormulaEval(t *testing.T) {
+	for _, c := range []struct {
+		formula string
+		want    string
+	}{
+		// precedence
+		{"1+2*3", "7"},
+		{"(1+2)*3", "9"},
+		{"2*-3", "-6"},
+		{"-2^2", "4"},
+		{"2^3^2", "64"},
+		{"10/4-1", "1.5"},
+		{"50%*2", "1"},
+		{"0.1+0.2", "0.3"},
+		{"1.5E2", "150"},
+
+		// references and ranges, text and empty cells are skipped
+		{"A1+A2", "3"},
+		{"$A$2*10", "20"},
+		{"B1*2", "6"},
+		{"SUM(A1:A4)", "3"},
+		{"SUM(A4:A1)", "3"},
+		{"COUNT(A1:A4)", "2"},
+		{"AVERAGE(A1:A3)", "1.5"},
+		{"MAX(A1:B1, 10)", "10"},
+		{"MIN(A1:B1)", "1"},
+
+		// other sheets
+		{"Base!A1+1", "101"},
+		{"'Base Stats'!A1*2", "14"},
+		{"SUM(Base!A1, 'Base Stats'!A1:A1)", "107"},
+
+		// functions
+		{"ROUND(2.675, 2)", "2.68"},
+		{"ROUNDUP(-1.2, 0)", "-2"},
+		{"ROUNDDOWN(-1.5, 0)", "-1"},
+		{"INT(-1.5)", "-2"},
+		{"ABS(-3)+SQRT(16)+POWER(2, 3)", "15"},
+	} {
+		got, evaluated := evalFormula(t, c.formula)
+		if got != c.want || !evaluated {
+			t.Errorf("%s = %s, %v, want %s evaluated", c.formula, got, evaluated, c.want)
+		}
+	}
+}
+
+func TestFormulaFallback(t *testing.T) {
+	for _, c := range []struct {
+		formula string
+		want    string
+	}{
+		// a formula of the range that cannot be evaluated
+		{"SUM(A1:C1)|9", "9"},
+		{"SUM(A1:A2)+C1|8", "8"},
+		{"VLOOKUP(1,A1:A2,1)|1", "1"},
+		{"D1+1|2", "2"},
+		{"A1/0|", ""},
+		{"A3+1|", ""},
+		{"NoSheet!A1|3", "3"},
+		{"A1:A2|1", "1"},
+		{"A1 A2|1", "1"},
+
+		// truncated formulas
+		{"SUM(1,|1", "1"},
+		{"SUM( |0", "0"},
+		{"SUM(A1|1", "1"},
+		{"1+|1", "1"},
+		{"'Base|1", "1"},
+	} {
+		got, evaluated := evalFormula(t, c.formula)
+		if got != c.want || evaluated {
+			t.Errorf("%s = %s, %v, want the cached %s", c.formula, got, evaluated, c.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -107,7 +108,9 @@ func jsonReadFromArray(jdata *simplejson.Json) ([][]string, error) {
 			row := make([]string, len(header))
 			m, _ := v.(map[string]interface{})
 			for kk, vv := range m {
-				row[header[kk]] = fmt.Sprint(vv)
+				if vv != nil {
+					row[header[kk]] = fmt.Sprint(vv)
+				}
 			}
 			values = append(values, row)
 		}
@@ -122,7 +125,7 @@ func jsonReadFromMap(jdata *simplejson.Json) ([][]string, error) {
 	if m, err := jdata.Map(); err == nil {
 		header := map[string]int{}
 		for _, v := range m {
-			if mm, err := v.(*simplejson.Json).Map(); err == nil {
+			if mm, ok := v.(map[string]interface{}); ok {
 				for hk, _ := range mm {
 					if _, ok := header[hk]; !ok {
 						index := len(header)
@@ -130,7 +133,7 @@ func jsonReadFromMap(jdata *simplejson.Json) ([][]string, error) {
 					}
 				}
 			} else {
-				return nil, err
+				return nil, errors.New("not support json format")
 			}
 		}
 
@@ -139,7 +142,7 @@ func jsonReadFromMap(jdata *simplejson.Json) ([][]string, error) {
 		values[0][0] = "ID"
 		for {
 			if _, ok := header[values[0][0]]; ok {
-				values[0][0] = "ID" + "_K"
+				values[0][0] += "_K"
 			} else {
 				break
 			}
@@ -151,9 +154,11 @@ func jsonReadFromMap(jdata *simplejson.Json) ([][]string, error) {
 		for k, v := range m {
 			row := make([]string, len(header)+1)
 			row[0] = k
-			mm, _ := v.(*simplejson.Json).Map()
+			mm, _ := v.(map[string]interface{})
 			for kk, vv := range mm {
-				row[header[kk]] = fmt.Sprint(vv)
+				if vv != nil {
+					row[header[kk]+1] = fmt.Sprint(vv)
+				}
 			}
 			values = append(values, row)
 		}
@@ -174,6 +179,9 @@ func (helper *JsonHelper) ReadArray() ([][]string, error) {
 		return nil, err
 	}
 
+	if v := jsonValue(jdata.Interface()); isNested(v) {
+		return flatten(v)
+	}
 	if value, err := jsonReadFromArray(jdata); err != os.ErrInvalid {
 		return value, err
 	} else if value, err := jsonReadFromMap(jdata); err != os.ErrInvalid {
@@ -191,23 +199,31 @@ func (helper *JsonHelper) WriteArray(values [][]string) error {
 	defer f.Close()
 	f.WriteString("[")
 
+	sep := ""
 	for i := 1; i < len(values); i++ {
 		if len(values[i]) == 0 {
 			continue
 		}
-		f.WriteString("{")
-		for j := 0; j < len(values[0]) && j < len(values[i]); j++ {
-			f.WriteString("\"" + values[0][j] + "\":\"" + strings.Replace(values[i][j], "\"", "\\\"", -1) + "\"")
-			if j != len(values[i])-1 {
-				f.WriteString(",")
+		var fields []string
+		for j := 0; j < len(values[0]); j++ {
+			cell := cellOf(values[i], j)
+			if cell == "" {
+				v, ok, err := emptyCell(i, j, values[0][j])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				if v == nil {
+					fields = append(fields, jsonQuote(values[0][j])+":null")
+					continue
+				}
 			}
+			fields = append(fields, jsonQuote(values[0][j])+":"+jsonQuote(cell))
 		}
-		if i != len(values)-1 {
-			f.WriteString("},")
-		} else {
-			f.WriteString("}")
-		}
-
+		f.WriteString(sep + "{" + strings.Join(fields, ",") + "}")
+		sep = ","
 	}
 	f.WriteString("]")
 
@@ -224,10 +240,53 @@ func (helper *JsonHelper) ReadMap(key string) (interface{}, error) {
 		return nil, err
 	}
 
-	return jdata.Interface(), nil
+	return jsonValue(jdata.Interface()), nil
+}
+
+// jsonArrayPart is the key holding the sequence of a lua table mixing a
+// sequence and other keys, {1, 2, n=2} is written {"[]":[1,2],"n":2}.
+const jsonArrayPart = "[]"
+
+// jsonValue converts the objects encoding mixed lua tables to LuaTable.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = jsonValue(v[k])
+		}
+		if array, ok := v[jsonArrayPart].([]interface{}); ok {
+			delete(v, jsonArrayPart)
+			return &LuaTable{Array: array, Hash: v}
+		}
+		return v
+	default:
+		return v
+	}
 }
 
 func interfaceToJsonFile(w *os.File, v interface{}) {
+	if v == nil {
+		w.WriteString("null")
+		return
+	}
+	if m, ok := v.(StringKeyed); ok {
+		v = map[string]interface{}(m)
+	}
+	if lt, ok := v.(*LuaTable); ok {
+		w.WriteString("{" + jsonQuote(jsonArrayPart) + ":")
+		interfaceToJsonFile(w, lt.Array)
+		for kk, vv := range lt.Hash {
+			w.WriteString("," + jsonQuote(kk) + ":")
+			interfaceToJsonFile(w, vv)
+		}
+		w.WriteString("}")
+		return
+	}
 	t := reflect.TypeOf(v)
 
 	switch t.Kind() {
@@ -246,9 +305,13 @@ func interfaceToJsonFile(w *os.File, v interface{}) {
 	case reflect.Float32:
 		fallthrough
 	case reflect.Float64:
-		w.Write([]byte(fmt.Sprint(v)))
+		w.WriteString(formatNumber(v))
 	case reflect.String:
-		w.Write([]byte("\"" + fmt.Sprint(v) + "\""))
+		if n, ok := v.(json.Number); ok {
+			w.WriteString(formatNumber(n))
+			return
+		}
+		w.WriteString(jsonQuote(fmt.Sprint(v)))
 	case reflect.Array:
 		fallthrough
 	case reflect.Slice:
@@ -262,7 +325,9 @@ func interfaceToJsonFile(w *os.File, v interface{}) {
 			interfaceToJsonFile(w, vv)
 			w.WriteString(",")
 		}
-		w.Seek(-1, 1)
+		if len(a) > 0 {
+			w.Seek(-1, 1)
+		}
 		w.WriteString("]")
 	case reflect.Map:
 		m, ok := v.(map[string]interface{})
@@ -272,11 +337,13 @@ func interfaceToJsonFile(w *os.File, v interface{}) {
 
 		w.WriteString("{")
 		for kk, vv := range m {
-			w.WriteString("\"" + kk + "\":")
+			w.WriteString(jsonQuote(kk) + ":")
 			interfaceToJsonFile(w, vv)
 			w.WriteString(",")
 		}
-		w.Seek(-1, 1)
+		if len(m) > 0 {
+			w.Seek(-1, 1)
+		}
 		w.WriteString("}")
 	default:
 		fmt.Println("v type of kind is ", t.Kind(), "not supported")
@@ -300,19 +367,19 @@ func (helper *JsonHelper) WriteMapString(values map[string]map[string]interface{
 		return err
 	}
 	defer f.Close()
-	f.WriteString("{")
+	var rows []string
 	for k, v := range values {
-		f.WriteString("\"" + k + "\":{")
+		var fields []string
 		for kk, vv := range v {
-			f.WriteString("\"" + kk + "\":\"")
-			f.WriteString(strings.Replace(fmt.Sprint(vv), "\"", "\\\"", -1))
-			f.WriteString("\",")
+			if vv == nil {
+				fields = append(fields, jsonQuote(kk)+":null")
+			} else {
+				fields = append(fields, jsonQuote(kk)+":"+jsonQuote(fmt.Sprint(vv)))
+			}
 		}
-		f.Seek(-1, 1)
-		f.WriteString("},")
+		rows = append(rows, jsonQuote(k)+":{"+strings.Join(fields, ",")+"}")
 	}
-	f.Seek(-1, 1)
-	f.WriteString("}")
+	f.WriteString("{" + strings.Join(rows, ",") + "}")
 
 	return nil
 }
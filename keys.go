@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var _idMin, _idMax int = -1, -1
+
+// SetIDRange limits the keys of the tables to "min..max", "" for no limit.
+func SetIDRange(r string) error {
+	_idMin, _idMax = -1, -1
+	if r == "" {
+		return nil
+	}
+	var err error
+	_idMin, _idMax, err = parseRange(r)
+	return err
+}
+
+// isBlank reports whether every cell of row is empty, such rows are ignored.
+func isBlank(row []string) bool {
+	for _, cell := range row {
+		if cell != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkKeys returns a violation for every data row, from first on, whose
+// key in column kindex is empty, duplicated, not a number when ktype is N or
+// out of the ID range. Keys other than S ones are compared as numbers.
+func checkKeys(data [][]string, first, kindex int, name, ktype string) []Violation {
+	var result []Violation
+	seen := map[string]int{}
+	for i := first; i < len(data); i++ {
+		if isBlank(data[i]) {
+			continue
+		}
+
+		key := cellOf(data[i], kindex)
+		if key == "" {
+			result = append(result, Violation{i, kindex, name, "empty key"})
+			continue
+		}
+		// 1001 and 1001.0 are the same number key
+		id := key
+		if ktype != "S" {
+			id = refValue(key)
+		}
+		if j, ok := seen[id]; ok {
+			result = append(result, Violation{i, kindex, name, "key " + strconv.Quote(key) + " duplicate of " + cellName(j, kindex)})
+			continue
+		}
+		seen[id] = i
+
+		if ktype != "N" && _idMin == -1 && _idMax == -1 {
+			continue
+		}
+		f, err := strconv.ParseFloat(key, 64)
+		if err != nil {
+			result = append(result, Violation{i, kindex, name, "key " + strconv.Quote(key) + " is not a number"})
+			continue
+		}
+		if _idMin != -1 && f < float64(_idMin) || _idMax != -1 && f > float64(_idMax) {
+			result = append(result, Violation{i, kindex, name, fmt.Sprintf("key %s out of ID range %d..%d", key, _idMin, _idMax)})
+		}
+	}
+	return result
+}
+
+// sortViolations orders violations by row, then column.
+func sortViolations(v []Violation) {
+	sort.SliceStable(v, func(i, j int) bool {
+		if v[i].Row != v[j].Row {
+			return v[i].Row < v[j].Row
+		}
+		return v[i].Col < v[j].Col
+	})
+}
+
+// violationsError reports every violation, one per line.
+func violationsError(v []Violation) error {
+	lines := make([]string, len(v))
+	for i := range v {
+		lines[i] = v[i].String()
+	}
+	return errors.New(strconv.Itoa(len(v)) + " key errors:\n\t" + strings.Join(lines, "\n\t"))
+}
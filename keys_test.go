@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckKeys(t *testing.T) {
+	data := [][]string{
+		{"ID", "Name"},
+		{"1001", "Sword"},
+		{"", "Bow"},
+		{"1001.0", "Axe"},
+		{"", ""},
+		{"1e3", "Staff"},
+		{"1000", "Wand"},
+		{"1001", "Spear"},
+		{"x", "Shield"},
+	}
+	for _, c := range []struct {
+		ktype string
+		want  []string
+	}{
+		{"N", []string{
+			"A3 ID: empty key",
+			`A4 ID: key "1001.0" duplicate of A2`,
+			`A7 ID: key "1000" duplicate of A6`,
+			`A8 ID: key "1001" duplicate of A2`,
+			`A9 ID: key "x" is not a number`,
+		}},
+		{"S", []string{
+			"A3 ID: empty key",
+			`A8 ID: key "1001" duplicate of A2`,
+		}},
+	} {
+		var got []string
+		for _, v := range checkKeys(data, 1, 0, "ID", c.ktype) {
+			got = append(got, v.String())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s keys: got %q, want %q", c.ktype, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+)
+
+// The layout of the sheets, rows count from 1:
+//
+//	row 1  ID      Name    #Note     header, the names or declarations
+//	row 2  编号    名称    备注      descriptions, for the schema comments
+//	row 3  KN      S                 types, joined to the names as Name_S
+//	row 4  1001    Sword   todo      data
+//	row 5  # cut for now             a comment row
+//
+// rows and columns starting with the comment prefix are designer notes and
+// skipped. The data starts after the last header, type, description and
+// constraint row unless set.
+type sheetLayout struct {
+	Header  int
+	Type    int
+	Desc    int
+	Data    int
+	Comment string
+}
+
+var _layout = sheetLayout{Header: 1}
+
+// SetLayout sets the header, type, description and first data row, 0 for no
+// type or description row and for the data right after the others, and the
+// prefix of comment rows and columns, "" for none.
+func SetLayout(header, typ, desc, data int, comment string) error {
+	if header < 1 || typ < 0 || desc < 0 || data < 0 {
+		return errors.New("invalid sheet layout, rows count from 1")
+	}
+	if typ == header || desc == header || typ != 0 && typ == desc {
+		return errors.New("the header, type and description rows must differ")
+	}
+	if data != 0 && (data <= header || data <= typ || data <= desc) {
+		return errors.New("the data must start after the header, type and description rows")
+	}
+	_layout = sheetLayout{Header: header, Type: typ, Desc: desc, Data: data, Comment: comment}
+	return nil
+}
+
+// dataRow returns the index of the first data row.
+func dataRow() int {
+	if _layout.Data > 0 {
+		return _layout.Data - 1
+	}
+	first := _layout.Header
+	for _, r := range []int{_layout.Type, _layout.Desc, _constraintRow} {
+		if r > first {
+			first = r
+		}
+	}
+	return first
+}
+
+// layoutIndex returns the index of the sheet row r in the data applyLayout
+// returns.
+func layoutIndex(r int) int {
+	switch r - 1 {
+	case 0:
+		return _layout.Header - 1
+	case _layout.Header - 1:
+		return 0
+	default:
+		return r - 1
+	}
+}
+
+// isComment reports whether a cell starts a designer note.
+func isComment(cell string) bool {
+	return _layout.Comment != "" && strings.HasPrefix(strings.TrimSpace(cell), _layout.Comment)
+}
+
+// applyLayout returns data with the header, types joined, as the first row.
+// The other rows keep their index so that cell names stay right: the
+// constraint and description rows are kept, other rows before the data,
+// comment rows and comment columns are emptied.
+func applyLayout(data [][]string) [][]string {
+	h := _layout.Header - 1
+	if h >= len(data) {
+		return data
+	}
+
+	result := make([][]string, len(data))
+	for i, row := range data {
+		result[i] = append([]string{}, row...)
+	}
+
+	header := result[h]
+	if _layout.Type > 0 && _layout.Type <= len(data) {
+		for j := range header {
+			if typ := strings.TrimSpace(cellOf(data[_layout.Type-1], j)); typ != "" && header[j] != "" {
+				header[j] += "_" + typ
+			}
+		}
+	}
+	for j, name := range data[h] {
+		if !isComment(name) {
+			continue
+		}
+		for _, row := range result {
+			if j < len(row) {
+				row[j] = ""
+			}
+		}
+	}
+
+	first := dataRow()
+	for i := range result {
+		switch {
+		case i == h:
+		case i < first && (i == _constraintRow-1 || i == _layout.Desc-1):
+		case i < first || isComment(cellOf(result[i], 0)):
+			result[i] = nil
+		}
+	}
+	result[0], result[h] = result[h], result[0]
+	return result
+}
+
+// readSheet reads the rows of a sheet after the layout.
+func readSheet(h Helper) ([][]string, error) {
+	data, err := h.ReadArray()
+	if err != nil {
+		return nil, err
+	}
+	return applyLayout(data), nil
+}
+
+// dataRows returns the header and the data rows of data read by readSheet,
+// without the description, constraint, comment and blank rows.
+func dataRows(data [][]string) [][]string {
+	if len(data) == 0 {
+		return data
+	}
+	result := [][]string{data[0]}
+	for i := dataRow(); i < len(data); i++ {
+		if !isBlank(data[i]) {
+			result = append(result, data[i])
+		}
+	}
+	return result
+}
+
+// loadDescriptions reads the descriptions of the columns from the
+// description row of data.
+func (t *TableConfig) loadDescriptions(data [][]string) {
+	t.descriptions = map[int]string{}
+	if _layout.Desc == 0 || _layout.Desc > len(data) {
+		return
+	}
+	row := data[layoutIndex(_layout.Desc)]
+	for _, c := range t.Columns() {
+		if desc := strings.TrimSpace(cellOf(row, c.Index)); desc != "" {
+			t.descriptions[c.Index] = desc
+		}
+	}
+}
+
+// layoutFlags adds the layout flags to fs, the returned function sets the
+// layout once fs is parsed.
+func layoutFlags(fs *flag.FlagSet) func() error {
+	header := fs.Int("hr", 1, "-hr row number of the header")
+	typ := fs.Int("tr", 0, "-tr row number of the types joined to the header names, 0 for none")
+	desc := fs.Int("dr", 0, "-dr row number of the column descriptions, 0 for none")
+	data := fs.Int("fr", 0, "-fr row number of the first data row, 0 for the row after the header rows")
+	comment := fs.String("comment", "", "-comment prefix of the comment rows and columns, like #")
+	return func() error {
+		return SetLayout(*header, *typ, *desc, *data, *comment)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sheetHelper is a Helper reading rows from memory and keeping the rows
+// written to it.
+type sheetHelper struct {
+	rows    [][]string
+	written [][]string
+}
+
+func (h *sheetHelper) ReadArray() ([][]string, error) {
+	return h.rows, nil
+}
+
+func (h *sheetHelper) WriteArray(values [][]string) error {
+	h.written = values
+	return nil
+}
+
+func (h *sheetHelper) ReadMap(key string) (interface{}, error) {
+	panic("sheetHelper not supported ReadMap")
+}
+
+func (h *sheetHelper) WriteMap(values interface{}) error {
+	panic("sheetHelper not supported WriteMap")
+}
+
+func (h *sheetHelper) WriteMapString(values map[string]map[string]interface{}) error {
+	panic("sheetHelper not supported WriteMapString")
+}
+
+// convertSheet converts rows of a sheet without key and returns the rows
+// written.
+func convertSheet(t *testing.T, rows [][]string) [][]string {
+	out := &sheetHelper{}
+	if err := tableConvert("test.csv", &sheetHelper{rows: rows}, out, ""); err != nil {
+		t.Fatal(err)
+	}
+	return out.written
+}
+
+func TestUntypedLayout(t *testing.T) {
+	if err := SetLayout(1, 0, 2, 0, "#"); err != nil {
+		t.Fatal(err)
+	}
+	SetConstraintRow(3)
+	defer SetLayout(1, 0, 0, 0, "")
+	defer SetConstraintRow(0)
+
+	got := convertSheet(t, [][]string{
+		{"Name", "Level", "#Note"},
+		{"名称", "等级", "备注"},
+		{"", "range(1, 99)", ""},
+		{"Sword", "1", "todo"},
+		{"# cut for now", "2", ""},
+		{"", "", ""},
+		{"Bow", "3", ""},
+	})
+	want := [][]string{
+		{"Name", "Level", ""},
+		{"Sword", "1", ""},
+		{"Bow", "3", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUntypedSide(t *testing.T) {
+	rows := [][]string{
+		{"Name", "Icon:C", "DropRate:S", "Side_SIDE"},
+		{"Sword", "sword.png", "0.5", ""},
+		{"Trap", "", "0.1", "S"},
+		{"Banner", "banner.png", "", "C"},
+	}
+	defer SetSide("all")
+
+	for _, c := range []struct {
+		side string
+		want [][]string
+	}{
+		{"client", [][]string{
+			{"Name", "Icon", "", ""},
+			{"Sword", "sword.png", "", ""},
+			{"Banner", "banner.png", "", ""},
+		}},
+		{"server", [][]string{
+			{"Name", "", "DropRate", ""},
+			{"Sword", "", "0.5", ""},
+			{"Trap", "", "0.1", ""},
+		}},
+		{"all", [][]string{
+			{"Name", "Icon", "DropRate", ""},
+			{"Sword", "sword.png", "0.5", ""},
+			{"Trap", "", "0.1", ""},
+			{"Banner", "banner.png", "", ""},
+		}},
+	} {
+		if err := SetSide(c.side); err != nil {
+			t.Fatal(err)
+		}
+		if got := convertSheet(t, rows); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.side, got, c.want)
+		}
+	}
+}
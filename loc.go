@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Localizer replaces the text of the columns declared with @Loc, like
+// Name_S@Loc, by string keys Table.RowKey.Column and keeps the text in a
+// string table per language in Dir:
+//
+//	zh.csv  en.csv     Key, Source, Text, Status for translators
+//	zh.lua  en.lua     key = text for the game
+//
+// Status is new for untranslated strings, stale when the source text
+// changed since the translation, ok otherwise.
+type Localizer struct {
+	Dir     string
+	Source  string
+	Langs   []string
+	Table   string
+	Runtime []string
+
+	// table name -> key -> source text of the inputs converted in this run
+	texts map[string]map[string]string
+}
+
+type locEntry struct {
+	Source string
+	Text   string
+	Status string
+}
+
+var _loc *Localizer = nil
+var _localizers map[string]*Localizer = map[string]*Localizer{}
+
+// SetLocalization enables the extraction of localizable text to dir, an
+// empty dir disables it. source is the language of the sheets, langs the
+// languages to translate to, table the type of the tables for translators
+// and runtime the types of the tables for the game.
+func SetLocalization(dir, source string, langs []string, table string, runtime []string) error {
+	if dir == "" {
+		_loc = nil
+		return nil
+	}
+	if source == "" {
+		return errors.New("localization needs the source language")
+	}
+	if table != "csv" && table != "xlsx" {
+		return errors.New("unknown string table type " + table + ", expect csv or xlsx")
+	}
+	for _, r := range runtime {
+		if r != "lua" && r != "json" {
+			return errors.New("unknown runtime string table type " + r + ", expect lua or json")
+		}
+	}
+
+	l, ok := _localizers[dir]
+	if !ok {
+		l = &Localizer{Dir: dir, texts: map[string]map[string]string{}}
+		_localizers[dir] = l
+	}
+	l.Source, l.Langs, l.Table, l.Runtime = source, langs, table, runtime
+	_loc = l
+	return nil
+}
+
+// Localized reports whether the text of the column is localizable.
+func (c *column) Localized() bool {
+	table, _ := splitRef(c.Ref)
+	return table == "Loc"
+}
+
+// locName returns the column part of the string keys of c.
+func (c column) locName() string {
+	name := c.Name
+	for _, p := range c.Path {
+		if i, ok := p.(int); ok {
+			name += "[" + strconv.Itoa(i) + "]"
+			continue
+		}
+		name += "." + p.(string)
+	}
+	return name
+}
+
+// Extract returns data with the text of the localizable columns replaced
+// by string keys and records the text.
+func (l *Localizer) Extract(path string, t *TableConfig, data [][]string) [][]string {
+	var cols []column
+	for _, c := range t.Columns() {
+		if c.Localized() && c.Type == "S" {
+			cols = append(cols, c)
+		}
+	}
+
+	table := tableName(path)
+	texts := map[string]string{}
+	l.texts[table] = texts
+	if len(cols) == 0 {
+		return data
+	}
+
+	result := make([][]string, len(data))
+	copy(result, data)
+	for i := t.firstRow(); i < len(data); i++ {
+		if isBlank(data[i]) {
+			continue
+		}
+		row := refValue(cellOf(data[i], t.key.Index))
+		result[i] = append([]string{}, data[i]...)
+		for _, c := range cols {
+			text := cellOf(data[i], c.Index)
+			if text == "" {
+				continue
+			}
+			key := table + "." + row + "." + c.locName()
+			texts[key] = text
+			result[i][c.Index] = key
+		}
+	}
+	return result
+}
+
+func (l *Localizer) tablePath(lang string) string {
+	return filepath.Join(l.Dir, lang+"."+l.Table)
+}
+
+// withSheet calls f with the sheet name used for the string tables.
+func withSheet(f func() error) error {
+	sheet := _sheet
+	SetSheetName("Strings")
+	defer SetSheetName(sheet)
+	return f()
+}
+
+// loadStrings reads a string table, a missing file is an empty table.
+func loadStrings(path string) (map[string]*locEntry, error) {
+	result := map[string]*locEntry{}
+	if _, err := os.Stat(path); err != nil {
+		return result, nil
+	}
+
+	var data [][]string
+	err := withSheet(func() error {
+		h, err := openInput(path, "")
+		if err == nil {
+			data, err = h.ReadArray()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return result, nil
+	}
+
+	columns := map[string]int{"Key": -1, "Source": -1, "Text": -1, "Status": -1}
+	for j, h := range data[0] {
+		if _, ok := columns[h]; ok {
+			columns[h] = j
+		}
+	}
+	if columns["Key"] == -1 || columns["Text"] == -1 {
+		return nil, errors.New(path + ": string table needs the columns Key and Text")
+	}
+	for _, row := range data[1:] {
+		key := cellOf(row, columns["Key"])
+		if key == "" {
+			continue
+		}
+		result[key] = &locEntry{Source: cellOf(row, columns["Source"]), Text: cellOf(row, columns["Text"]), Status: cellOf(row, columns["Status"])}
+	}
+	return result, nil
+}
+
+func (l *Localizer) save(lang string, entries map[string]*locEntry) error {
+	var keys []string
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := [][]string{{"Key", "Source", "Text", "Status"}}
+	runtime := StringKeyed{}
+	for _, k := range keys {
+		e := entries[k]
+		data = append(data, []string{k, e.Source, e.Text, e.Status})
+		runtime[k] = e.Text
+		if e.Text == "" {
+			runtime[k] = e.Source
+		}
+	}
+
+	if err := os.MkdirAll(l.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	err := withSheet(func() error {
+		h, err := newfunc[l.Table](l.tablePath(lang))
+		if err == nil {
+			err = h.WriteArray(data)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range l.Runtime {
+		h, err := newfunc[r](filepath.Join(l.Dir, lang+"."+r))
+		if err == nil {
+			err = h.WriteMap(runtime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop removes the strings of table, whose input was deleted, unless it was
+// converted in this run.
+func (l *Localizer) Drop(table string) {
+	if _, ok := l.texts[table]; !ok {
+		l.texts[table] = map[string]string{}
+	}
+}
+
+// Save merges the text of the inputs converted in this run into the string
+// table of every language, the strings of other inputs are kept.
+func (l *Localizer) Save() error {
+	for _, lang := range append([]string{l.Source}, l.Langs...) {
+		entries, err := loadStrings(l.tablePath(lang))
+		if err != nil {
+			return err
+		}
+
+		for table, texts := range l.texts {
+			for key := range entries {
+				if strings.HasPrefix(key, table+".") {
+					if _, ok := texts[key]; !ok {
+						delete(entries, key)
+					}
+				}
+			}
+			for key, text := range texts {
+				e, ok := entries[key]
+				switch {
+				case lang == l.Source:
+					entries[key] = &locEntry{Source: text, Text: text, Status: "ok"}
+				case !ok:
+					entries[key] = &locEntry{Source: text, Status: "new"}
+				case e.Source != text:
+					e.Source = text
+					if e.Text != "" {
+						e.Status = "stale"
+					}
+				}
+			}
+		}
+
+		if err := l.save(lang, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import merges the translations of file into the string table of lang,
+// translations of an outdated source text are reported and skipped.
+func (l *Localizer) Import(file, lang string) ([]string, error) {
+	entries, err := loadStrings(l.tablePath(lang))
+	if err != nil {
+		return nil, err
+	}
+	translated, err := loadStrings(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for key, t := range translated {
+		e, ok := entries[key]
+		switch {
+		case !ok:
+			problems = append(problems, key+": unknown key")
+		case t.Source != "" && t.Source != e.Source:
+			problems = append(problems, key+": translated from an outdated source text")
+		case t.Text != "":
+			e.Text, e.Status = t.Text, "ok"
+		}
+	}
+	sort.Strings(problems)
+	return problems, l.save(lang, entries)
+}
+
+func runLoc(args []string) int {
+	fs := flag.NewFlagSet("loc", flag.ExitOnError)
+	dir := fs.String("dir", "loc", "-dir directory of the string tables")
+	lang := fs.String("lang", "", "-lang language of the translations")
+	table := fs.String("type", "csv", "-type type of the string tables, csv or xlsx")
+	runtime := fs.String("runtime", "lua", "-runtime comma separated types of the string tables for the game, lua or json")
+	setCsv := csvFlags(fs)
+	fs.Usage = commandUsage(fs, "loc -lang lang [-dir dir] [-type csv|xlsx] [-runtime types] [-csvsep sep] [-csvcomment char] [-csvenc encoding] [-csvlazy] [-csvbom] translated files...")
+	fs.Parse(args)
+
+	if *lang == "" || fs.NArg() == 0 {
+		fs.Usage()
+	}
+	if err := setCsv(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := SetLocalization(*dir, *lang, nil, *table, splitList(*runtime)); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	failed := 0
+	for _, file := range fs.Args() {
+		problems, err := _loc.Import(file, *lang)
+		for _, p := range problems {
+			log.Println(file, p)
+		}
+		if err != nil {
+			log.Println(file, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 
 	"github.com/yuin/gopher-lua"
 )
@@ -41,6 +45,7 @@ func luaTableType(t *lua.LTable) (map[string]int, lua.LValueType) {
 	header := map[string]int{}
 
 	t.ForEach(func(k, v lua.LValue) {
+		v = luaRaw(v)
 		if v.Type() != lua.LTTable {
 			ktype = lua.LTNil
 			return
@@ -73,6 +78,7 @@ func luaTableType(t *lua.LTable) (map[string]int, lua.LValueType) {
 				id += "_K"
 			} else {
 				header[id] = 0
+				break
 			}
 		}
 	}
@@ -83,21 +89,33 @@ func luaTableType(t *lua.LTable) (map[string]int, lua.LValueType) {
 func LValueToString(l lua.LValue) string {
 	switch l.Type() {
 	case lua.LTNil:
-		return "nil"
+		return ""
 	case lua.LTBool:
 		return l.(lua.LValue).String()
 	case lua.LTNumber:
-		return l.(lua.LValue).String()
+		return formatNumber(float64(l.(lua.LNumber)))
 	case lua.LTString:
-		return "\"" + l.(lua.LValue).String() + "\""
+		return luaQuote(l.(lua.LValue).String())
 	case lua.LTTable:
+		t := luaRaw(l).(*lua.LTable)
+		n := luaSequence(t)
 		strbuf := bytes.NewBuffer([]byte{})
 		strbuf.WriteString("{")
-		l.(*lua.LTable).ForEach(func(k, v lua.LValue) {
-			if k.Type() == lua.LTNumber {
-				strbuf.WriteString(LValueToString(v))
-				strbuf.WriteString(",")
+		for i := 1; i <= n; i++ {
+			strbuf.WriteString(LValueToString(t.RawGetInt(i)))
+			strbuf.WriteString(",")
+		}
+		t.ForEach(func(k, v lua.LValue) {
+			if f, ok := k.(lua.LNumber); ok {
+				if float64(f) == math.Trunc(float64(f)) && f >= 1 && int(f) <= n {
+					return
+				}
+				strbuf.WriteString("[" + luaKeyText(k) + "]=")
+			} else {
+				strbuf.WriteString(luaKey(k.String(), true) + "=")
 			}
+			strbuf.WriteString(LValueToString(v))
+			strbuf.WriteString(",")
 		})
 		strbuf.WriteString("}")
 		return strbuf.String()
@@ -109,18 +127,24 @@ func LValueToString(l lua.LValue) string {
 func (helper *LuaHelper) ReadArray() (value [][]string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = r.(error)
+			err = panicError(r)
 		}
 	}()
-	L := lua.NewState()
-	L.OpenLibs()
+	L := luaSandbox()
 	defer L.Close()
-	L.DoFile(helper.name)
-
-	basename := filepath.Base(helper.name)
-	basename = basename[0 : len(basename)-4]
+	v, err := helper.load(L)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, errors.New(helper.name + " does not define a table")
+	}
+	if rows := luaValueToInterface(t); isNested(rows) {
+		return flatten(rows)
+	}
 
-	t := L.GetGlobal(basename).(*lua.LTable)
+	t = luaRaw(t).(*lua.LTable)
 	header, ltype := luaTableType(t)
 	value = make([][]string, 1)
 	value[0] = make([]string, len(header))
@@ -132,20 +156,20 @@ func (helper *LuaHelper) ReadArray() (value [][]string, err error) {
 	} else if ltype == lua.LTNumber {
 		t.ForEach(func(k, v lua.LValue) {
 			row := make([]string, len(header))
-			v.(*lua.LTable).ForEach(func(kk, vv lua.LValue) {
+			luaRaw(v).(*lua.LTable).ForEach(func(kk, vv lua.LValue) {
 				row[header[kk.String()]] = LValueToString(vv)
 			})
 			value = append(value, row)
 		})
 	} else {
-		row := make([]string, len(header))
 		t.ForEach(func(k, v lua.LValue) {
+			row := make([]string, len(header))
 			row[0] = k.String()
-			v.(*lua.LTable).ForEach(func(kk, vv lua.LValue) {
+			luaRaw(v).(*lua.LTable).ForEach(func(kk, vv lua.LValue) {
 				row[header[kk.String()]] = LValueToString(vv)
 			})
+			value = append(value, row)
 		})
-		value = append(value, row)
 	}
 
 	return
@@ -160,81 +184,213 @@ func (helper *LuaHelper) WriteArray(values [][]string) error {
 		return err
 	}
 	defer f.Close()
-	f.WriteString(basename + "={\n")
+	f.WriteString(luaPrefix(basename) + "{\n")
 
 	for i := 1; i < len(values); i++ {
 		f.WriteString("\t{\n")
-		for j := 0; j < len(values[0]) && j < len(values[i]); j++ {
-			f.WriteString("\t\t" + values[0][j] + "=" + values[i][j] + ",\n")
+		for j := 0; j < len(values[0]); j++ {
+			value := cellOf(values[i], j)
+			if value == "" {
+				v, ok, err := emptyCell(i, j, values[0][j])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				if v == nil {
+					value = "nil"
+				} else {
+					value = luaString("")
+				}
+			} else {
+				value = luaCell(value)
+			}
+			f.WriteString("\t\t" + luaKey(values[0][j], true) + "=" + value + ",\n")
 		}
 		f.WriteString("\t},\n")
 	}
-	f.WriteString("}\n")
+	f.WriteString("}" + luaSuffix(basename))
 
 	return nil
 }
 
+// luaKeyText returns the text of a table key, numbers as formatNumber does.
+func luaKeyText(k lua.LValue) string {
+	if n, ok := k.(lua.LNumber); ok {
+		return formatNumber(float64(n))
+	}
+	return k.String()
+}
+
+// luaSequence returns the n of the keys 1..n of t.
+func luaSequence(t *lua.LTable) int {
+	n := 0
+	for t.RawGetInt(n+1) != lua.LNil {
+		n++
+	}
+	return n
+}
+
 func luaValueToInterface(l lua.LValue) interface{} {
 	switch l.Type() {
 	case lua.LTNil:
 		return nil
 	case lua.LTBool:
-		return (bool)(*(l.(*lua.LBool)))
+		return bool(l.(lua.LBool))
 	case lua.LTNumber:
-		return (float64)(*(l.(*lua.LNumber)))
+		return luaNumber(float64(l.(lua.LNumber)))
 	case lua.LTString:
 		return l.(lua.LString).String()
 	case lua.LTTable:
-		var result interface{}
+		t := luaRaw(l).(*lua.LTable)
+		n := luaSequence(t)
+		numbers, strs, numstrs := 0, 0, 0
+		t.ForEach(func(k, v lua.LValue) {
+			switch {
+			case k.Type() == lua.LTNumber:
+				numbers++
+			case k.Type() != lua.LTString:
+				panic(errors.New("not support key of type " + k.Type().String()))
+			case isNumberKey(k.String()):
+				numstrs++
+				strs++
+			default:
+				strs++
+			}
+		})
+		if numbers > 0 && numstrs > 0 {
+			panic(errors.New("not support string keys looking like numbers mixed with number keys"))
+		}
 
-		l.(*lua.LTable).ForEach(func(k, v lua.LValue) {
-			if k.Type() == lua.LTNumber {
-				if result == nil {
-					result = []interface{}{}
-				}
-				if inst, ok := result.([]interface{}); ok {
-					result = append(inst, luaValueToInterface(v))
-				} else {
-					panic("not support mix key with number and string")
-				}
-			} else {
-				if result == nil {
-					result = make(map[string]interface{})
-				}
+		// a sequence 1..n is an array, other numeric keys are kept in a map
+		if numbers > 0 && strs == 0 && n == numbers {
+			result := make([]interface{}, numbers)
+			for i := 1; i <= numbers; i++ {
+				result[i-1] = luaValueToInterface(t.RawGetInt(i))
+			}
+			return result
+		}
 
-				if inst, ok := result.(map[string]interface{}); ok {
-					inst[k.String()] = luaValueToInterface(v)
-				} else {
-					panic("not support mix key with number and string")
-				}
+		if numbers == 0 && strs == 0 {
+			return nil
+		}
+
+		// a sequence followed by other keys, like {1, 2, 3, n=3}
+		mixed := n > 0 && strs > 0
+		result := make(map[string]interface{})
+		t.ForEach(func(k, v lua.LValue) {
+			if f, ok := k.(lua.LNumber); ok && mixed && float64(f) == math.Trunc(float64(f)) && f >= 1 && int(f) <= n {
+				return
 			}
+			result[luaKeyText(k)] = luaValueToInterface(v)
 		})
-
+		if mixed {
+			array := make([]interface{}, n)
+			for i := 1; i <= n; i++ {
+				array[i-1] = luaValueToInterface(t.RawGetInt(i))
+			}
+			return &LuaTable{Array: array, Hash: result}
+		}
+		if numstrs > 0 {
+			return StringKeyed(result)
+		}
 		return result
 	default:
-		panic("not supported lua type")
+		panic(errors.New("not support value of type " + l.Type().String()))
 	}
 }
 
-func (helper *LuaHelper) ReadMap(key string) (interface{}, error) {
-	L := lua.NewState()
-	L.OpenLibs()
+// panicError returns the value recovered from a panic as an error.
+func panicError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", r)
+}
+
+func (helper *LuaHelper) ReadMap(key string) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(r)
+		}
+	}()
+	L := luaSandbox()
 	defer L.Close()
-	err := L.DoFile(helper.name)
+	v, err := helper.load(L)
 	if err != nil {
 		return nil, err
 	}
 
-	basename := filepath.Base(helper.name)
-	basename = basename[0 : len(basename)-4]
+	return luaValueToInterface(v), nil
+}
 
-	fmt.Println(basename)
+var luaReserved = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
 
-	v := L.GetGlobal(basename)
-	return luaValueToInterface(v), nil
+var luaIdentifier = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// isNumberKey reports whether the key k is written as a number, that is k
+// is how a lua number prints.
+func isNumberKey(k string) bool {
+	_, err := strconv.ParseFloat(k, 64)
+	return err == nil && refValue(k) == k
+}
+
+// luaKey returns k as the key of a table constructor field: a bare name
+// for identifiers, [1001] for numbers and ["a key"] otherwise. Keys of
+// tables with string keys are never numbers.
+func luaKey(k string, strkeys bool) string {
+	switch {
+	case !strkeys && isNumberKey(k):
+		return "[" + k + "]"
+	case luaIdentifier.MatchString(k) && !luaReserved[k]:
+		return k
+	default:
+		return "[" + luaQuote(k) + "]"
+	}
 }
 
 func interfaceToLuaFile(w *os.File, v interface{}, newline bool) {
+	if v == nil {
+		w.WriteString("nil")
+		return
+	}
+	if code, ok := v.(LuaCode); ok {
+		w.WriteString(string(code))
+		return
+	}
+	strkeys := false
+	if m, ok := v.(StringKeyed); ok {
+		v, strkeys = map[string]interface{}(m), true
+	}
+	if lt, ok := v.(*LuaTable); ok {
+		w.WriteString("{")
+		for _, vv := range lt.Array {
+			if newline {
+				w.WriteString("\n\t")
+			}
+			interfaceToLuaFile(w, vv, false)
+			w.WriteString(",")
+		}
+		for kk, vv := range lt.Hash {
+			if newline {
+				w.WriteString("\n\t")
+			}
+			w.WriteString(luaKey(kk, false) + "=")
+			interfaceToLuaFile(w, vv, false)
+			w.WriteString(",")
+		}
+		if newline {
+			w.WriteString("\n")
+		}
+		w.WriteString("}")
+		return
+	}
 	t := reflect.TypeOf(v)
 
 	switch t.Kind() {
@@ -253,9 +409,13 @@ func interfaceToLuaFile(w *os.File, v interface{}, newline bool) {
 	case reflect.Float32:
 		fallthrough
 	case reflect.Float64:
-		w.Write([]byte(fmt.Sprint(v)))
+		w.WriteString(formatNumber(v))
 	case reflect.String:
-		w.Write([]byte("\"" + fmt.Sprint(v) + "\""))
+		if n, ok := v.(json.Number); ok {
+			w.WriteString(formatNumber(n))
+			return
+		}
+		w.WriteString(luaString(fmt.Sprint(v)))
 	case reflect.Array:
 		fallthrough
 	case reflect.Slice:
@@ -275,7 +435,9 @@ func interfaceToLuaFile(w *os.File, v interface{}, newline bool) {
 				w.WriteString("\n\t")
 			}
 		}
-		w.Seek(-1, 1)
+		if len(a) > 0 || newline {
+			w.Seek(-1, 1)
+		}
 		w.WriteString("}")
 	case reflect.Map:
 		m, ok := v.(map[string]interface{})
@@ -288,14 +450,16 @@ func interfaceToLuaFile(w *os.File, v interface{}, newline bool) {
 			w.WriteString("\n\t")
 		}
 		for kk, vv := range m {
-			w.WriteString(kk + "=")
+			w.WriteString(luaKey(kk, strkeys) + "=")
 			interfaceToLuaFile(w, vv, false)
 			w.WriteString(",")
 			if newline {
 				w.WriteString("\n\t")
 			}
 		}
-		w.Seek(-1, 1)
+		if len(m) > 0 || newline {
+			w.Seek(-1, 1)
+		}
 		w.WriteString("}")
 	default:
 		fmt.Println("v type of kind is ", t.Kind(), "not supported")
@@ -311,9 +475,9 @@ func (helper *LuaHelper) WriteMap(values interface{}) error {
 
 	basename := filepath.Base(helper.name)
 	basename = basename[0 : len(basename)-4]
-	f.WriteString(basename + "=")
-
+	f.WriteString(luaPrefix(basename))
 	interfaceToLuaFile(f, values, true)
+	f.WriteString(luaSuffix(basename))
 
 	return nil
 }
@@ -322,22 +486,26 @@ func (helper *LuaHelper) WriteMapString(values map[string]map[string]interface{}
 	basename := filepath.Base(helper.name)
 	basename = basename[0 : len(basename)-4]
 
-	f, err := os.OpenFile(helper.name, os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	f, err := os.OpenFile(helper.name, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	f.WriteString(basename + "={\n")
+	f.WriteString(luaPrefix(basename) + "{\n")
 	for k, v := range values {
-		f.WriteString("\t" + k + "={\n")
+		f.WriteString("\t" + luaKey(k, false) + "={\n")
 		for kk, vv := range v {
-			f.WriteString("\t\t" + kk + "=")
-			f.WriteString(fmt.Sprint(vv))
+			f.WriteString("\t\t" + luaKey(kk, true) + "=")
+			if vv == nil {
+				f.WriteString("nil")
+			} else {
+				f.WriteString(luaCell(fmt.Sprint(vv)))
+			}
 			f.WriteString(",\n")
 		}
 		f.WriteString("\t},\n")
 	}
-	f.WriteString("}\n")
+	f.WriteString("}" + luaSuffix(basename))
 
 	return nil
 }
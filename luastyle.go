@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// the styles of lua output:
+//
+//	global    items={...}
+//	local     local items={...} return items
+//	module    return {...}
+//	readonly  like local, writing to the table or its subtables is an error
+var luaStyles = map[string]bool{"global": true, "local": true, "module": true, "readonly": true}
+
+var _luaStyle string = "global"
+
+// SetLuaStyle sets how lua output defines its table, see luaStyles.
+func SetLuaStyle(style string) error {
+	if style == "" {
+		style = "global"
+	}
+	if !luaStyles[style] {
+		return errors.New("unknown lua style " + style + ", expect global, local, module or readonly")
+	}
+	_luaStyle = style
+	return nil
+}
+
+// luaReadonly wraps a table and its subtables in proxies raising an error on
+// writes, pairs and # see through them from lua 5.2 on.
+const luaReadonly = `local function readonly(t)
+	for k, v in pairs(t) do
+		if type(v) == "table" then
+			t[k] = readonly(v)
+		end
+	end
+	return setmetatable({}, {
+		__index = t,
+		__newindex = function(_, k)
+			error("attempt to modify read-only field " .. tostring(k), 2)
+		end,
+		__len = function()
+			return #t
+		end,
+		__pairs = function()
+			return next, t, nil
+		end,
+	})
+end
+
+`
+
+// luaName returns the lua name of the table defined by the file path.
+func luaName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// luaLocal returns name as a local variable name.
+func luaLocal(name string) string {
+	if luaIdentifier.MatchString(name) && !luaReserved[name] {
+		return name
+	}
+	return "data"
+}
+
+// luaPrefix returns what is written before the table named name.
+func luaPrefix(name string) string {
+	switch _luaStyle {
+	case "local":
+		return "local " + luaLocal(name) + "="
+	case "module":
+		return "return "
+	case "readonly":
+		return luaReadonly + "local " + luaLocal(name) + "=readonly("
+	default:
+		if luaIdentifier.MatchString(name) && !luaReserved[name] {
+			return name + "="
+		}
+		return "_G[" + luaQuote(name) + "]="
+	}
+}
+
+// luaSuffix returns what is written after the table named name.
+func luaSuffix(name string) string {
+	switch _luaStyle {
+	case "local":
+		return "\nreturn " + luaLocal(name) + "\n"
+	case "readonly":
+		return ")\nreturn " + luaLocal(name) + "\n"
+	default:
+		return "\n"
+	}
+}
+
+// load runs the file and returns the global named after it, or the value
+// the chunk returns when there is no such global, so every style is read.
+func (helper *LuaHelper) load(L *lua.LState) (lua.LValue, error) {
+	ret, err := luaDoFile(L, helper.name)
+	if err != nil {
+		return nil, err
+	}
+
+	name := luaName(helper.name)
+	if v := L.GetGlobal(name); v.Type() != lua.LTNil {
+		return v, nil
+	}
+	if ret.Type() == lua.LTNil {
+		return nil, errors.New(helper.name + " neither defines " + name + " nor returns a value")
+	}
+	return ret, nil
+}
+
+// luaRaw returns the table behind a read-only proxy, other values as they are.
+func luaRaw(v lua.LValue) lua.LValue {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return v
+	}
+	mt, ok := t.Metatable.(*lua.LTable)
+	if !ok {
+		return v
+	}
+	if k, _ := t.Next(lua.LNil); k != lua.LNil {
+		return v
+	}
+	if index, ok := mt.RawGetString("__index").(*lua.LTable); ok {
+		return luaRaw(index)
+	}
+	return v
+}
@@ -3,18 +3,32 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
 func Usage() {
-	fmt.Fprintln(os.Stderr, "Usage of ", os.Args[0], " [-i dir] [-o dir] [-it type to convert]] [-ot type convert to] [-k key] [-s sheet]")
-	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "Usage of ", os.Args[0], " command [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  convert   convert a file or the files in a directory")
+	fmt.Fprintln(os.Stderr, "  validate  check files against the header type declarations")
+	fmt.Fprintln(os.Stderr, "  diff      compare the data of two files")
+	fmt.Fprintln(os.Stderr, "  inspect   show sheets, header and size of a file")
+	fmt.Fprintln(os.Stderr, "  build     run the jobs of a project file")
+	fmt.Fprintln(os.Stderr, "  schema    generate lua annotations from the header type declarations")
+	fmt.Fprintln(os.Stderr, "  loc       import translated string tables")
+	fmt.Fprintln(os.Stderr, "use ", os.Args[0], " command -h for the arguments of a command")
 	os.Exit(0)
 }
 
+func commandUsage(fs *flag.FlagSet, args string) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, "Usage of ", os.Args[0], " "+args)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+}
+
 type Helper interface {
 	ReadArray() ([][]string, error)
 	WriteArray(values [][]string) error
@@ -25,120 +39,6 @@ type Helper interface {
 
 var newfunc map[string](func(string) (Helper, error))
 
-func aaConvert(idir, odir, itype, otype string) {
-	filepath.Walk(idir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatal(err)
-			return err
-		}
-
-		if info.Mode().IsRegular() && filepath.Ext(path) == "."+itype {
-			log.Println(path, itype, otype)
-			ifile, err := newfunc[itype](path)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			cfile, err := newfunc[otype](odir + "/" + strings.Replace(info.Name(), "."+itype, "."+otype, -1))
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			data, err := ifile.ReadArray()
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			err = cfile.WriteArray(data)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-		}
-
-		return nil
-	})
-}
-
-func mmConvert(idir, odir, itype, otype, key string) {
-	filepath.Walk(idir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatal(err)
-			return err
-		}
-
-		if info.Mode().IsRegular() && filepath.Ext(path) == "."+itype {
-			log.Println(path, itype, otype)
-			ifile, err := newfunc[itype](path)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			cfile, err := newfunc[otype](odir + "/" + strings.Replace(info.Name(), "."+itype, "."+otype, -1))
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			data, err := ifile.ReadMap(key)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			err = cfile.WriteMap(data)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-		}
-
-		return nil
-	})
-}
-
-func mmStringConvert(idir, odir, itype, otype, key string) {
-	filepath.Walk(idir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatal(err)
-			return err
-		}
-
-		if info.Mode().IsRegular() && filepath.Ext(path) == "."+itype {
-			log.Println(path, itype, otype)
-			ifile, err := newfunc[itype](path)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			cfile, err := newfunc[otype](odir + "/" + strings.Replace(info.Name(), "."+itype, "."+otype, -1))
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			data, err := ifile.ReadMap(key)
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-
-			err = cfile.WriteMapString(data.(map[string]map[string]interface{}))
-			if err != nil {
-				log.Println(path, err)
-				return nil
-			}
-		}
-
-		return nil
-	})
-}
-
 func main() {
 	newfunc = map[string](func(string) (Helper, error)){
 		"xlsx": NewXlsxHelper,
@@ -146,38 +46,29 @@ func main() {
 		"lua":  NewLuaHelper,
 		"json": NewJsonHelper,
 	}
-	idir := flag.String("i", "test", "-i dir")
-	odir := flag.String("o", "test", "-o dir")
-	itype := flag.String("it", "json", "-it type")
-	otype := flag.String("ot", "lua", "-ot type")
-	key := flag.String("k", "ID", "-k key")
 
-	sheet := flag.String("s", "Sheet1", "-s sheet")
-	SetSheetName(*sheet)
+	commands := map[string]func([]string) int{
+		"convert":  runConvert,
+		"validate": runValidate,
+		"diff":     runDiff,
+		"inspect":  runInspect,
+		"build":    runBuild,
+		"schema":   runSchema,
+		"loc":      runLoc,
+	}
 
-	flag.Usage = Usage
-	flag.Parse()
+	if len(os.Args) < 2 {
+		Usage()
+	}
 
-	ctype := *itype + "2" + *otype
-	switch {
-	case ctype == "xlsx2csv" || ctype == "csv2xlsx":
-		fallthrough
-	case ctype == "lua2xlsx" || ctype == "lua2csv":
-		fallthrough
-	case ctype == "json2xlsx" || ctype == "json2csv":
-		fallthrough
-	case (ctype == "xlsx2json" || ctype == "csv2json") && *key == "":
-		fallthrough
-	case (ctype == "xlsx2lua" || ctype == "csv2lua") && *key == "":
-		aaConvert(*idir, *odir, *itype, *otype)
-	case (ctype == "xlsx2json" || ctype == "csv2json"):
-		fallthrough
-	case (ctype == "xlsx2lua" || ctype == "csv2lua"):
-		mmStringConvert(*idir, *odir, *itype, *otype, *key)
-	case (ctype == "json2lua" || ctype == "lua2json"):
-		mmConvert(*idir, *odir, *itype, *otype, *key)
-	default:
-		log.Fatal("not support convert ", ctype)
+	// without a command the arguments are the ones of convert, as in older versions
+	if strings.HasPrefix(os.Args[1], "-") && os.Args[1] != "-h" && os.Args[1] != "-help" {
+		os.Exit(runConvert(os.Args[1:]))
 	}
 
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		Usage()
+	}
+	os.Exit(run(os.Args[2:]))
 }
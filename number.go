@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// parseNumber parses the text of a number, integers are kept as int64 so
+// ids beyond 2^53 stay exact.
+func parseNumber(cell string) (interface{}, error) {
+	if i, err := strconv.ParseInt(cell, 10, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(cell, 64)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// luaNumber returns a lua number as int64 when it is an integer.
+func luaNumber(f float64) interface{} {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f)
+	}
+	return f
+}
+
+// formatNumber returns the text of a number, integers are written without
+// decimal point or exponent.
+func formatNumber(v interface{}) string {
+	switch n := v.(type) {
+	case json.Number:
+		if _, err := n.Int64(); err == nil {
+			return n.String()
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return n.String()
+		}
+		return formatNumber(f)
+	case float32:
+		return formatNumber(float64(n))
+	case float64:
+		if n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		return strconv.FormatFloat(n, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type refInput struct {
+	path    string
+	options readOptions
+	refs    []string
+}
+
+// readOptions are the options reading a sheet depends on, a sheet read
+// again at Check is read as it was seen, not with the options of the last
+// job of a build.
+type readOptions struct {
+	sheet       string
+	layout      sheetLayout
+	constraints int
+	csvSep      string
+	csvComment  string
+	csvEncoding string
+	csvLazy     bool
+	fillMerged  bool
+	skipHidden  []string
+	formula     string
+}
+
+func currentReadOptions() readOptions {
+	return readOptions{
+		sheet:       _sheet,
+		layout:      _layout,
+		constraints: _constraintRow,
+		csvSep:      _csvSep,
+		csvComment:  _csvComment,
+		csvEncoding: _csvEncoding,
+		csvLazy:     _csvLazyQuotes,
+		fillMerged:  _fillMerged,
+		skipHidden:  _skipHidden,
+		formula:     _formulaPolicy,
+	}
+}
+
+// apply sets the options and returns a function restoring the previous.
+func (o readOptions) apply() func() {
+	previous := currentReadOptions()
+	o.set()
+	return previous.set
+}
+
+func (o readOptions) set() {
+	SetSheetName(o.sheet)
+	_layout = o.layout
+	_constraintRow = o.constraints
+	_csvSep, _csvComment, _csvEncoding, _csvLazyQuotes = o.csvSep, o.csvComment, o.csvEncoding, o.csvLazy
+	_fillMerged, _skipHidden = o.fillMerged, o.skipHidden
+	_formulaPolicy = o.formula
+}
+
+type refTable struct {
+	path string
+	t    *TableConfig
+	data [][]string
+}
+
+// RefChecker collects the sheets of a run and checks the references declared
+// with @Table.Field between them once all are known. A referenced value must
+// exist in column Field of Table, or in its key column when Field is empty.
+// Enum is not a table, @Enum.Name declares an enum column, nor is Loc,
+// @Loc declares a localizable column.
+type RefChecker struct {
+	inputs map[string]*refInput
+	tables map[string]*refTable
+	dups   map[string][]string
+}
+
+var _refs *RefChecker = NewRefChecker()
+
+func NewRefChecker() *RefChecker {
+	return &RefChecker{inputs: map[string]*refInput{}, tables: map[string]*refTable{}, dups: map[string][]string{}}
+}
+
+func tableName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// splitRef splits a reference declaration like Item.ID into table and field.
+func splitRef(ref string) (string, string) {
+	parts := strings.SplitN(ref, ".", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// refValue normalizes numbers so that 1001 and 1001.0 refer to the same key.
+func refValue(cell string) string {
+	if n, err := parseNumber(cell); err == nil {
+		return formatNumber(n)
+	}
+	return cell
+}
+
+// References returns the tables referenced by the columns of t.
+func (t *TableConfig) References() []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, c := range t.Columns() {
+		if c.Ref == "" || c.Enum() != "" || c.Localized() {
+			continue
+		}
+		table, _ := splitRef(c.Ref)
+		if !seen[table] {
+			seen[table] = true
+			result = append(result, table)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// See records the sheet input path, refs are the tables it is known to
+// reference without reading it again.
+func (r *RefChecker) See(path string, refs []string) {
+	name := tableName(path)
+	if in, ok := r.inputs[name]; ok && in.path != path {
+		// references to the name are reported as ambiguous
+		r.dups[name] = append(r.dups[name], path)
+		return
+	}
+	r.inputs[name] = &refInput{path: path, options: currentReadOptions(), refs: refs}
+}
+
+// Add records a sheet already read, so Check does not read it again.
+func (r *RefChecker) Add(path string, t *TableConfig, data [][]string) {
+	name := tableName(path)
+	if _, ok := r.inputs[name]; !ok {
+		r.inputs[name] = &refInput{path: path, options: currentReadOptions()}
+	}
+	r.inputs[name].refs = t.References()
+	r.tables[name] = &refTable{path: path, t: t, data: data}
+}
+
+// Refs returns the tables referenced by the sheet of path, as far as known.
+func (r *RefChecker) Refs(path string) []string {
+	if in, ok := r.inputs[tableName(path)]; ok && in.path == path {
+		return in.refs
+	}
+	return nil
+}
+
+func (r *RefChecker) load(name string) (*refTable, error) {
+	in, ok := r.inputs[name]
+	if !ok {
+		return nil, errors.New("table " + name + " not found")
+	}
+	if dups, ok := r.dups[name]; ok {
+		return nil, errors.New("table " + name + " is ambiguous: " + strings.Join(append([]string{in.path}, dups...), ", "))
+	}
+	if t, ok := r.tables[name]; ok {
+		return t, nil
+	}
+
+	defer in.options.apply()()
+
+	h, err := openInput(in.path, "")
+	if err != nil {
+		return nil, err
+	}
+	data, err := readSheet(h)
+	if err != nil {
+		return nil, err
+	}
+	t, err := LoadTable(in.path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	r.tables[name] = &refTable{path: in.path, t: t, data: data}
+	return r.tables[name], nil
+}
+
+// values returns the column field, or the key column when field is empty,
+// and its cells indexed by their normalized value.
+func (rt *refTable) values(field string) (column, map[string]int, error) {
+	if field == "" {
+		if rt.t.key.Index == -1 {
+			return column{}, nil, errors.New("table " + tableName(rt.path) + " has no key column")
+		}
+		field = rt.t.key.Name
+	}
+
+	cols, ok := rt.t.cols[field]
+	if !ok || len(cols[0].Path) > 0 {
+		return column{}, nil, errors.New("table " + tableName(rt.path) + " has no column " + field)
+	}
+
+	result := map[string]int{}
+	for i := rt.t.firstRow(); i < len(rt.data); i++ {
+		if cell := cellOf(rt.data[i], cols[0].Index); cell != "" {
+			result[refValue(cell)] = i
+		}
+	}
+	return cols[0], result, nil
+}
+
+// Check resolves the references of every sheet declaring some and returns
+// the problems found, dangling references name the source cell and the
+// target column.
+func (r *RefChecker) Check() []string {
+	var names []string
+	for name, in := range r.inputs {
+		if len(in.refs) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var result []string
+	for _, name := range names {
+		src, err := r.load(name)
+		if err != nil {
+			result = append(result, r.inputs[name].path+": "+err.Error())
+			continue
+		}
+
+		for _, c := range src.t.Columns() {
+			if c.Ref == "" || c.Enum() != "" || c.Localized() {
+				continue
+			}
+
+			table, field := splitRef(c.Ref)
+			dst, err := r.load(table)
+			var target column
+			var values map[string]int
+			if err == nil {
+				target, values, err = dst.values(field)
+			}
+			if err != nil {
+				result = append(result, src.path+": "+cellName(0, c.Index)+" "+c.Name+": "+err.Error())
+				continue
+			}
+
+			for i := src.t.firstRow(); i < len(src.data); i++ {
+				cell := cellOf(src.data[i], c.Index)
+				if cell == "" {
+					continue
+				}
+				elements := []string{cell}
+				if cellTypes[c.Type] {
+					// every element of a cell array is a reference
+					elements, _ = cellElements(c.Type, cell)
+				}
+				for _, e := range elements {
+					if _, ok := values[refValue(strings.TrimSpace(e))]; !ok {
+						result = append(result, src.path+": "+cellName(i, c.Index)+" "+c.Name+": "+strconv.Quote(e)+
+							" not found in "+dst.path+" column "+columnName(target.Index)+" "+table+"."+target.Name)
+					}
+				}
+			}
+		}
+	}
+	return result
+}
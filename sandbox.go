@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var _luaTimeout time.Duration = 5 * time.Second
+var _luaMemory uint64 = 256 << 20
+
+// SetLuaLimits sets how long a lua input may run and how many bytes it may
+// allocate while running, 0 for no limit.
+func SetLuaLimits(timeout time.Duration, memory uint64) {
+	_luaTimeout = timeout
+	_luaMemory = memory
+}
+
+// luaSandbox returns a state with the base, string, table and math libraries
+// only, lua inputs can neither reach the filesystem nor the process.
+func luaSandbox() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// the base library loads files too
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	// functions building a big string at once would pass the memory limit
+	// before it is polled, they check the size first
+	str := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	luaLimitSize(L, str, "string.rep", func(L *lua.LState) float64 {
+		return float64(len(L.CheckString(1))) * float64(L.CheckInt(2))
+	})
+	luaLimitSize(L, str, "string.format", luaFormatSize)
+	luaLimitSize(L, str, "string.gsub", luaGsubSize)
+	luaLimitSize(L, L.GetGlobal(lua.TabLibName).(*lua.LTable), "table.concat", luaConcatSize)
+	return L
+}
+
+// luaLimitSize replaces the function name of lib by one raising an error
+// when size, the most bytes the call may allocate, exceeds the memory limit.
+func luaLimitSize(L *lua.LState, lib *lua.LTable, name string, size func(L *lua.LState) float64) {
+	field := name[strings.Index(name, ".")+1:]
+	f := lib.RawGetString(field).(*lua.LFunction)
+	lib.RawSetString(field, L.NewFunction(func(L *lua.LState) int {
+		if _luaMemory > 0 && size(L) > float64(_luaMemory) {
+			L.RaiseError("%s exceeded the memory limit of %d MB", name, _luaMemory>>20)
+		}
+		return f.GFunction(L)
+	}))
+}
+
+// luaValueSize returns the length of the text of a string or number.
+func luaValueSize(v lua.LValue) float64 {
+	if s, ok := v.(lua.LString); ok {
+		return float64(len(s))
+	}
+	return 32
+}
+
+var formatWidth = regexp.MustCompile(`%[-+ #0]*([0-9]*)(?:\.([0-9]*))?`)
+
+// luaFormatSize returns the most bytes of string.format, the text of the
+// arguments and the widths of the format.
+func luaFormatSize(L *lua.LState) float64 {
+	format := L.CheckString(1)
+	size := float64(len(format))
+	for _, m := range formatWidth.FindAllStringSubmatch(format, -1) {
+		for _, n := range m[1:] {
+			if w, err := strconv.Atoi(n); err == nil {
+				size += float64(w)
+			}
+		}
+	}
+	for i := 2; i <= L.GetTop(); i++ {
+		size += luaValueSize(L.Get(i))
+	}
+	return size
+}
+
+// luaGsubSize returns the most bytes of string.gsub, every match replaced
+// by the longest replacement. Captures in a replacement string copy at most
+// the whole string as the matches do not overlap.
+func luaGsubSize(L *lua.LState) float64 {
+	s := float64(len(L.CheckString(1)))
+	matches := s + 1
+	if n := L.OptInt(4, -1); n >= 0 && float64(n) < matches {
+		matches = float64(n)
+	}
+	switch repl := L.Get(3).(type) {
+	case lua.LString:
+		return s + matches*float64(len(repl)) + float64(strings.Count(string(repl), "%"))*s
+	case *lua.LTable:
+		longest := 0.0
+		repl.ForEach(func(k, v lua.LValue) {
+			if size := luaValueSize(v); size > longest {
+				longest = size
+			}
+		})
+		return s + matches*longest
+	}
+	// a function runs lua for every match, which polls the limit
+	return s
+}
+
+// luaConcatSize returns the most bytes of table.concat.
+func luaConcatSize(L *lua.LState) float64 {
+	t := L.CheckTable(1)
+	sep := float64(len(L.OptString(2, "")))
+	i, j := L.OptInt(3, 1), L.OptInt(4, t.Len())
+	if i < 1 {
+		i = 1
+	}
+	if j > t.Len() {
+		j = t.Len()
+	}
+	size := 0.0
+	for ; i <= j; i++ {
+		size += luaValueSize(t.RawGetInt(i)) + sep
+	}
+	return size
+}
+
+// luaDoFile runs the file path in L within the limits and returns the value
+// the chunk returns.
+func luaDoFile(L *lua.LState, path string) (lua.LValue, error) {
+	fn, err := L.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return luaCall(L, fn, path)
+}
+
+// luaCall calls the chunk fn loaded from path within the limits. The memory
+// limit is checked every few milliseconds against the heap of the whole
+// process, so it is approximate, and by the functions luaSandbox limits
+// before they allocate.
+func luaCall(L *lua.LState, fn *lua.LFunction, path string) (lua.LValue, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if _luaTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), _luaTimeout)
+	}
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	outOfMemory := make(chan bool, 1)
+	done := make(chan bool)
+	defer close(done)
+	if limit := _luaMemory; limit > 0 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		base := stats.HeapAlloc
+		go func() {
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					runtime.ReadMemStats(&stats)
+					if stats.HeapAlloc > base+limit {
+						outOfMemory <- true
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		select {
+		case <-outOfMemory:
+			return nil, fmt.Errorf("%s exceeded the memory limit of %d MB", path, _luaMemory>>20)
+		default:
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%s exceeded the time limit of %v", path, _luaTimeout)
+		}
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Constraint is what a column declares beyond its type, either in the
+// constraint row of the sheet:
+//
+//	required;unique;min=0;max=100;regex=^\w+$;enum=a|b|c;len=1..20;count=1..5;empty=null
+//
+// or in a sidecar file named after the input with the .schema extension:
+//
+//	schema = {
+//		Price = {required = true, min = 0, max = 100},
+//		Name = {len = {1, 20}, regex = "^[A-Z]\\w*$"},
+//		Reward = {count = {1, 5}, empty = "default"},
+//	}
+//
+// len limits the length of strings, count the number of elements of an array
+// column, empty is the policy for empty cells, see emptyPolicies.
+type Constraint struct {
+	Required bool
+	Unique   bool
+	Min      *float64
+	Max      *float64
+	Regex    *regexp.Regexp
+	Enum     map[string]bool
+	MinLen   int
+	MaxLen   int
+	MinCount int
+	MaxCount int
+	Empty    string
+}
+
+// Violation is a cell breaking its declaration, Row and Col count from 0.
+type Violation struct {
+	Row     int
+	Col     int
+	Column  string
+	Message string
+}
+
+var _constraintRow int = 0
+
+// SetConstraintRow sets the sheet row, counted from 1, holding the column
+// constraints, 0 when the sheet has none.
+func SetConstraintRow(r int) {
+	_constraintRow = r
+}
+
+// columnName returns the spreadsheet name of a column, like B.
+func columnName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
+
+// cellName returns the spreadsheet name of a cell, like B3.
+func cellName(row, col int) string {
+	return columnName(col) + strconv.Itoa(row+1)
+}
+
+func (v Violation) String() string {
+	return cellName(v.Row, v.Col) + " " + v.Column + ": " + v.Message
+}
+
+func newConstraint() *Constraint {
+	return &Constraint{MinLen: -1, MaxLen: -1, MinCount: -1, MaxCount: -1}
+}
+
+// parseRange parses "a..b", "a.." or "..b", a missing bound is -1.
+func parseRange(s string) (int, int, error) {
+	lo, hi := -1, -1
+	parts := strings.SplitN(s, "..", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	var err error
+	if parts[0] != "" {
+		if lo, err = strconv.Atoi(parts[0]); err != nil {
+			return lo, hi, errors.New("invalid range " + s)
+		}
+	}
+	if parts[1] != "" {
+		if hi, err = strconv.Atoi(parts[1]); err != nil {
+			return lo, hi, errors.New("invalid range " + s)
+		}
+	}
+	return lo, hi, nil
+}
+
+func (c *Constraint) set(name, value string) error {
+	var err error
+	switch name {
+	case "required":
+		c.Required = true
+	case "unique":
+		c.Unique = true
+	case "min", "max":
+		f, perr := strconv.ParseFloat(value, 64)
+		if perr != nil {
+			return errors.New("invalid " + name + " " + value)
+		}
+		if name == "min" {
+			c.Min = &f
+		} else {
+			c.Max = &f
+		}
+	case "regex":
+		c.Regex, err = regexp.Compile(value)
+	case "enum":
+		c.Enum = map[string]bool{}
+		for _, e := range strings.Split(value, "|") {
+			c.Enum[e] = true
+		}
+	case "len":
+		c.MinLen, c.MaxLen, err = parseRange(value)
+	case "count":
+		c.MinCount, c.MaxCount, err = parseRange(value)
+	case "empty":
+		if !emptyPolicies[value] {
+			return errors.New("unknown empty policy " + value)
+		}
+		c.Empty = value
+	default:
+		err = errors.New("unknown constraint " + name)
+	}
+	return err
+}
+
+// ParseConstraint parses the text of a constraint row cell into c.
+func ParseConstraint(c *Constraint, text string) error {
+	for _, item := range strings.Split(text, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		if err := c.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func luaConstraint(t *lua.LTable) (*Constraint, error) {
+	c := newConstraint()
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		name := k.String()
+		switch {
+		case v.Type() == lua.LTBool:
+			if lua.LVAsBool(v) {
+				err = c.set(name, "")
+			}
+		case name == "enum" && v.Type() == lua.LTTable:
+			err = c.set(name, strings.Join(luaStrings(v), "|"))
+		case v.Type() == lua.LTTable:
+			bounds := luaStrings(v)
+			if len(bounds) != 2 {
+				err = errors.New(name + " must be {min, max}")
+				return
+			}
+			err = c.set(name, bounds[0]+".."+bounds[1])
+		default:
+			err = c.set(name, v.String())
+		}
+	})
+	return c, err
+}
+
+// schemaFile returns the sidecar schema file of the input path.
+func schemaFile(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".schema"
+}
+
+func loadSchemaFile(name string) (map[string]*Constraint, error) {
+	L := luaSandbox()
+	defer L.Close()
+	if _, err := luaDoFile(L, name); err != nil {
+		return nil, err
+	}
+
+	t, ok := L.GetGlobal("schema").(*lua.LTable)
+	if !ok {
+		return nil, errors.New(name + " does not define schema")
+	}
+
+	result := map[string]*Constraint{}
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		ct, ok := v.(*lua.LTable)
+		if !ok {
+			err = errors.New(name + " " + k.String() + " must be a table")
+			return
+		}
+		var c *Constraint
+		if c, err = luaConstraint(ct); err != nil {
+			err = errors.New(name + " " + k.String() + ": " + err.Error())
+		}
+		result[k.String()] = c
+	})
+	return result, err
+}
+
+// LoadConstraints reads the constraints of the columns from the constraint
+// row of data and from the sidecar schema file of path.
+func (t *TableConfig) LoadConstraints(path string, data [][]string) error {
+	t.constraints = map[string]*Constraint{}
+
+	if _constraintRow > 0 && _constraintRow != _layout.Header && _constraintRow <= len(data) {
+		row := data[layoutIndex(_constraintRow)]
+		for _, c := range t.Columns() {
+			if c.Index >= len(row) || row[c.Index] == "" {
+				continue
+			}
+			ct, ok := t.constraints[c.Name]
+			if !ok {
+				ct = newConstraint()
+				t.constraints[c.Name] = ct
+			}
+			if err := ParseConstraint(ct, row[c.Index]); err != nil {
+				return errors.New(cellName(_constraintRow-1, c.Index) + " " + c.Name + ": " + err.Error())
+			}
+		}
+	}
+
+	if _, err := os.Stat(schemaFile(path)); err != nil {
+		return nil
+	}
+	constraints, err := loadSchemaFile(schemaFile(path))
+	if err != nil {
+		return err
+	}
+	for name, c := range constraints {
+		if _, ok := t.cols[name]; !ok {
+			return errors.New(schemaFile(path) + ": no column " + name)
+		}
+		// the sidecar file wins over the constraint row
+		t.constraints[name] = c
+	}
+	return nil
+}
+
+// LoadTable parses the header declarations of data and the constraints of
+// its columns, path is the file data was read from.
+func LoadTable(path string, data [][]string) (*TableConfig, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty sheet")
+	}
+
+	t := &TableConfig{}
+	if err := t.init(data[0]); err != nil {
+		return nil, err
+	}
+	if err := t.LoadConstraints(path, data); err != nil {
+		return nil, err
+	}
+	t.loadDescriptions(data)
+	return t, nil
+}
+
+// firstRow returns the index of the first data row.
+func (t *TableConfig) firstRow() int {
+	return t.first
+}
+
+func (c *Constraint) checkCell(cell string, col column) string {
+	if c.Enum != nil && !c.Enum[cell] {
+		return strconv.Quote(cell) + " not in enum"
+	}
+	if c.Regex != nil && !c.Regex.MatchString(cell) {
+		return strconv.Quote(cell) + " not match " + c.Regex.String()
+	}
+	if n := utf8.RuneCountInString(cell); col.Type == "S" && (c.MinLen >= 0 && n < c.MinLen || c.MaxLen >= 0 && n > c.MaxLen) {
+		return fmt.Sprintf("length %d out of range %d..%d", n, c.MinLen, c.MaxLen)
+	}
+	if c.Min != nil || c.Max != nil {
+		f, err := strconv.ParseFloat(cell, 64)
+		if col.Type == "DATE" || col.Type == "DUR" {
+			f, err = timeNumber(cell, col)
+		}
+		if err != nil {
+			return strconv.Quote(cell) + " is not a number"
+		}
+		if c.Min != nil && f < *c.Min {
+			return fmt.Sprint(cell, " less than min ", *c.Min)
+		}
+		if c.Max != nil && f > *c.Max {
+			return fmt.Sprint(cell, " greater than max ", *c.Max)
+		}
+	}
+	return ""
+}
+
+// Validate checks every data cell against the type and constraints of its
+// column and returns all the violations.
+func (t *TableConfig) Validate(data [][]string) []Violation {
+	var result []Violation
+	columns := t.Columns()
+	seen := map[int]map[string]int{}
+
+	for i := t.firstRow(); i < len(data); i++ {
+		row := data[i]
+		if isBlank(row) {
+			continue
+		}
+		if tag := strings.TrimSpace(cellOf(row, t.side)); t.side != -1 && !validSide(tag) {
+			result = append(result, Violation{i, t.side, "side", "invalid side " + strconv.Quote(tag) + ", expect C, S or CS"})
+		}
+		elements := map[string]map[interface{}]bool{}
+		for _, col := range columns {
+			cell := cellOf(row, col.Index)
+			c := t.constraints[col.Name]
+			if c == nil {
+				c = newConstraint()
+			}
+
+			// the key is checked by checkKeys
+			iskey := col.Index == t.key.Index
+			if cell == "" {
+				if c.required() && !iskey && len(col.Path) == 0 {
+					result = append(result, Violation{i, col.Index, col.Name, "required"})
+				}
+				continue
+			}
+			if len(col.Path) > 0 {
+				if elements[col.Name] == nil {
+					elements[col.Name] = map[interface{}]bool{}
+				}
+				elements[col.Name][col.Path[0]] = true
+			}
+
+			if _, err := col.Value(cell); err != nil {
+				if !iskey {
+					result = append(result, Violation{i, col.Index, col.Name, err.Error()})
+				}
+				continue
+			}
+			var msg string
+			if cellTypes[col.Type] {
+				msg = c.checkElements(cell, col)
+			} else {
+				if enum := col.Enum(); enum != "" {
+					cell, _ = enumValue(enum, cell)
+				}
+				msg = c.checkCell(cell, col)
+			}
+			if msg != "" {
+				result = append(result, Violation{i, col.Index, col.Name, msg})
+			}
+
+			if c.Unique && !iskey {
+				if seen[col.Index] == nil {
+					seen[col.Index] = map[string]int{}
+				}
+				if first, ok := seen[col.Index][cell]; ok {
+					result = append(result, Violation{i, col.Index, col.Name, strconv.Quote(cell) + " duplicate of " + cellName(first, col.Index)})
+				} else {
+					seen[col.Index][cell] = i
+				}
+			}
+		}
+
+		for name, cols := range t.cols {
+			c := t.constraints[name]
+			if c == nil {
+				c = newConstraint()
+			}
+			if len(cols[0].Path) == 0 {
+				continue
+			}
+			n := len(elements[name])
+			if c.required() && n == 0 {
+				result = append(result, Violation{i, cols[0].Index, name, "required"})
+			}
+			if c.MinCount >= 0 && n < c.MinCount || c.MaxCount >= 0 && n > c.MaxCount {
+				result = append(result, Violation{i, cols[0].Index, name, fmt.Sprintf("%d elements out of range %d..%d", n, c.MinCount, c.MaxCount)})
+			}
+		}
+	}
+
+	if t.key.Index != -1 {
+		result = append(result, checkKeys(data, t.firstRow(), t.key.Index, t.key.Name, t.key.Type)...)
+		sortViolations(result)
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Columns and rows are exported to the client, the server or both:
+//
+//	DropRate_N:S   server only
+//	Icon_S:C       client only
+//	Name_S         both, like Name_S:CS
+//	Side_SIDE      tags the rows the same way with C, S or CS, empty for both
+//
+// an output selects a side with SetSide, all keeps everything.
+var sides = map[string]string{"all": "", "client": "C", "server": "S"}
+
+var _side string = "all"
+
+// SetSide sets which columns and rows are exported, client, server or all.
+func SetSide(side string) error {
+	if side == "" {
+		side = "all"
+	}
+	if _, ok := sides[side]; !ok {
+		return errors.New("unknown side " + side + ", expect client, server or all")
+	}
+	_side = side
+	return nil
+}
+
+var sideMarker = regexp.MustCompile(`^(.*):(C|S|CS|SC)$`)
+
+var sideColumn = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*_SIDE$`)
+
+// splitSide splits the side marker from a header, "" when it has none.
+func splitSide(header string) (string, string) {
+	if m := sideMarker.FindStringSubmatch(header); m != nil {
+		return m[1], m[2]
+	}
+	return header, ""
+}
+
+// validSide reports whether tag is a side tag, empty for both.
+func validSide(tag string) bool {
+	switch strings.ToUpper(tag) {
+	case "", "C", "S", "CS", "SC":
+		return true
+	}
+	return false
+}
+
+// sideIncluded reports whether what is tagged with tag is exported.
+func sideIncluded(tag string) bool {
+	return _side == "all" || tag == "" || strings.Contains(strings.ToUpper(tag), sides[_side])
+}
+
+// included reports whether any of the columns of a field is exported.
+func included(cols []column) bool {
+	for _, c := range cols {
+		if sideIncluded(c.Side) {
+			return true
+		}
+	}
+	return false
+}
+
+// rowIncluded reports whether row is exported after its side tag.
+func (t *TableConfig) rowIncluded(row []string) bool {
+	return t.side == -1 || sideIncluded(strings.TrimSpace(cellOf(row, t.side)))
+}
+
+// untypedSide applies the side markers of a sheet without type declarations
+// read by readSheet: like comments, the columns and rows not exported are
+// emptied, and the markers are removed from the header.
+func untypedSide(data [][]string) [][]string {
+	if len(data) == 0 {
+		return data
+	}
+
+	side := -1
+	var dropped []int
+	for j, name := range data[0] {
+		name, tag := splitSide(name)
+		if sideColumn.MatchString(name) {
+			side = j
+		}
+		if j == side || !sideIncluded(tag) {
+			dropped = append(dropped, j)
+		}
+		data[0][j] = name
+	}
+
+	for i, row := range data {
+		if i >= dataRow() && side != -1 && !sideIncluded(strings.TrimSpace(cellOf(row, side))) {
+			data[i] = nil
+			continue
+		}
+		for _, j := range dropped {
+			if j < len(row) {
+				row[j] = ""
+			}
+		}
+	}
+	return data
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
-	"util"
+	"strings"
 )
 
 type column struct {
@@ -12,11 +14,32 @@ type column struct {
 	Type  string
 	Name  string
 	ExVal []string
+	Path  []interface{} // array indices (int) and table fields (string) below Name
+	Ref   string        // the @table.field suffix without @
+	Side  string        // C or S for columns of one side, see sides
+}
+
+// LuaCode is the text of an L column, written to lua without quotes.
+type LuaCode string
+
+// StringKeyed is a table whose keys are strings even when they look like
+// numbers, like the rows of a table with a _KS key column.
+type StringKeyed map[string]interface{}
+
+// LuaTable is a lua table with a sequence 1..n and other keys, like
+// {1, 2, 3, n=3}. Keys of Hash looking like numbers are numbers.
+type LuaTable struct {
+	Array []interface{}
+	Hash  map[string]interface{}
 }
 
 type TableConfig struct {
-	key  column
-	cols map[string][]column
+	key          column
+	side         int // the index of the row side tag column, -1 when none
+	first        int // the index of the first data row
+	cols         map[string][]column
+	constraints  map[string]*Constraint
+	descriptions map[int]string // column index -> description
 }
 
 func matchone(str string, re map[string]*regexp.Regexp) ([]string, string) {
@@ -36,10 +59,10 @@ func matchone(str string, re map[string]*regexp.Regexp) ([]string, string) {
 
 func (t *TableConfig) addColumn(c column) error {
 	if col, ok := t.cols[c.Name]; ok {
-		if col[0].Type != c.Type {
-			return errors.New("duplicate column name with different types")
-		} else if c.Type == "L" || c.Type == "S" || c.Type == "N" || c.Type == "B" {
+		if len(col[0].Path) == 0 || len(c.Path) == 0 {
 			return errors.New("duplicate column name with simple type")
+		} else if col[0].Type != c.Type && !col[0].isPath() && !c.isPath() {
+			return errors.New("duplicate column name with different types")
 		} else {
 			col = append(col, c)
 			t.cols[c.Name] = col
@@ -51,6 +74,37 @@ func (t *TableConfig) addColumn(c column) error {
 	}
 }
 
+func columnPath(tt string, rr []string) ([]interface{}, error) {
+	var layout []int
+	switch tt {
+	case "A":
+		layout = []int{2}
+	case "AT":
+		layout = []int{2, -3}
+	case "T":
+		layout = []int{-2}
+	case "TA":
+		layout = []int{-2, 3}
+	case "ATA":
+		layout = []int{2, -3, 4}
+	}
+
+	// positive entries are array indices, negative ones table fields
+	var path []interface{}
+	for _, g := range layout {
+		if g < 0 {
+			path = append(path, rr[-g])
+			continue
+		}
+		idx, err := strconv.Atoi(rr[g])
+		if err != nil || idx < 1 {
+			return nil, errors.New("array index " + rr[g] + " must start from 1")
+		}
+		path = append(path, idx)
+	}
+	return path, nil
+}
+
 func (t *TableConfig) init(row []string) error {
 	remap := make(map[string]*regexp.Regexp)
 
@@ -61,15 +115,30 @@ func (t *TableConfig) init(row []string) error {
 	remap["A"] = regexp.MustCompile("^([a-zA-Z][a-z0-9A-Z]*)_A_(\\d+)" + atreg + "$")
 	remap["T"] = regexp.MustCompile("^([a-zA-Z][a-z0-9A-Z]*)_T_([a-zA-Z][a-z0-9A-Z]*)" + atreg + "$")
 	remap["TA"] = regexp.MustCompile("^([a-zA-Z][a-z0-9A-Z]*)_T_([a-zA-Z][a-z0-9A-Z]*)_(\\d+)" + atreg + "$")
-	remap["N"] = regexp.MustCompile("^([a-zA-Z][a-z0-9A-Z]*)_([LSNB])" + atreg + "$")
+	remap["N"] = regexp.MustCompile("^([a-zA-Z][a-z0-9A-Z]*)_([LSNB]|AA?[NSB]|J|LT|DATE|DUR)" + atreg + "$")
+	pathreg := regexp.MustCompile("^([a-zA-Z_][a-zA-Z0-9_]*)((?:\\[\\d+\\]|\\.[^.\\[\\]@]+)*)_([LSNB])" + atreg + "$")
 
 	exp := regexp.MustCompile("^([a-zA-Z][a-z0-9A-Z]*)_K([NS])$")
 
 	t.key = column{Index: -1}
+	t.side = -1
+	t.first = dataRow()
 	t.cols = make(map[string][]column)
 	for i := 0; i < len(row); i++ {
-		ids := exp.FindAllStringSubmatch(row[i], -1)
+		header, side := splitSide(row[i])
+		if sideColumn.MatchString(header) {
+			if t.side != -1 {
+				return errors.New("multiple side column not supported")
+			}
+			t.side = i
+			continue
+		}
+
+		ids := exp.FindAllStringSubmatch(header, -1)
 		if len(ids) == 1 {
+			if side != "" {
+				return errors.New("column " + row[i] + ": the key column can not be limited to one side")
+			}
 			if t.key.Index != -1 {
 				return errors.New("multiple key not supported")
 			}
@@ -80,11 +149,37 @@ func (t *TableConfig) init(row []string) error {
 				return err
 			}
 		} else {
-			rr, tt := matchone(row[i], remap)
+			rr, tt := matchone(header, remap)
 			if rr != nil {
-				if err := t.addColumn(column{Index: i, Type: tt, Name: rr[1], ExVal: rr}); err != nil {
-					return err
+				path, err := columnPath(tt, rr)
+				if err != nil {
+					return errors.New("column " + row[i] + ": " + err.Error())
+				}
+				ref := strings.TrimPrefix(rr[len(rr)-2], "@")
+				if table, _ := splitRef(ref); (tt == "J" || tt == "LT") && ref != "" && table != "Enum" && table != "Loc" {
+					return errors.New("column " + row[i] + ": a json or lua table cell can not reference a table")
+				}
+				if err := t.addColumn(column{Index: i, Type: tt, Name: rr[1], ExVal: rr, Path: path, Ref: ref, Side: side}); err != nil {
+					return errors.New("column " + row[i] + ": " + err.Error())
+				}
+			} else if rr := pathreg.FindStringSubmatch(header); rr != nil {
+				path, err := parsePath(rr[2])
+				if err != nil {
+					return errors.New("column " + row[i] + ": " + err.Error())
 				}
+				ref := strings.TrimPrefix(rr[len(rr)-2], "@")
+				if err := t.addColumn(column{Index: i, Type: rr[3], Name: rr[1], ExVal: rr, Path: path, Ref: ref, Side: side}); err != nil {
+					return errors.New("column " + row[i] + ": " + err.Error())
+				}
+			}
+		}
+	}
+
+	// row numbers change when rows are inserted, the strings need a key
+	if t.key.Index == -1 {
+		for _, c := range t.Columns() {
+			if c.Localized() {
+				return errors.New("column " + row[c.Index] + ": a localized column needs a key column")
 			}
 		}
 	}
@@ -92,123 +187,191 @@ func (t *TableConfig) init(row []string) error {
 	return nil
 }
 
-func (t *TableConfig) ParseRow(row []string, includekey bool) map[string]string {
-	result := make(map[string]string)
-	for name, cols := range t.cols {
-		if !includekey && name == t.key.Name {
-			continue
-		}
+// HasSchema reports whether the header declared any column with the type DSL.
+func (t *TableConfig) HasSchema() bool {
+	return len(t.cols) > 0
+}
+
+// Columns returns the declared columns in sheet order.
+func (t *TableConfig) Columns() []column {
+	var result []column
+	for _, cols := range t.cols {
+		result = append(result, cols...)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result
+}
+
+// setIndex stores value under arr[k-1] following path, arr grows as needed.
+func setIndex(arr []interface{}, k int, path []interface{}, value interface{}) []interface{} {
+	for len(arr) < k {
+		arr = append(arr, nil)
+	}
+	arr[k-1] = setPath(arr[k-1], path, value)
+	return arr
+}
 
-		switch cols[0].Type {
-		case "B", "N":
-			result[name] = row[cols[0].Index]
-		case "S":
-			result[name] = "\"" + row[cols[0].Index] + "\""
-		case "L":
-		case "A":
-		case "AT":
-		case "T":
-		case "TA":
-		case "ATA":
+// setPath stores value under container following path and returns the
+// updated container, arrays grow as needed and are indexed from 1. A table
+// given both indices and fields becomes a LuaTable.
+func setPath(container interface{}, path []interface{}, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch k := path[0].(type) {
+	case int:
+		switch c := container.(type) {
+		case *LuaTable:
+			c.Array = setIndex(c.Array, k, path[1:], value)
+			return c
+		case map[string]interface{}:
+			return &LuaTable{Array: setIndex(nil, k, path[1:], value), Hash: c}
 		default:
-			panic("invalid type")
+			arr, _ := container.([]interface{})
+			return setIndex(arr, k, path[1:], value)
+		}
+	default:
+		switch c := container.(type) {
+		case *LuaTable:
+			c.Hash[k.(string)] = setPath(c.Hash[k.(string)], path[1:], value)
+			return c
+		case []interface{}:
+			return &LuaTable{Array: c, Hash: map[string]interface{}{k.(string): setPath(nil, path[1:], value)}}
+		}
+		m, ok := container.(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
 		}
+		m[k.(string)] = setPath(m[k.(string)], path[1:], value)
+		return m
 	}
-	for i, val := range t.cols {
-		if val.Type == "L" {
-			base := row.Cells[i].String()
-			if base == "" {
-				continue
-			} else if len(val.ExVal) == 2 || val.ExVal[3] == "" {
-				v.NVal = name + "." + row.Cells[i].String()
-			} else {
-				v.NVal = FormatAtString(row.Cells[i].String(), val.ExVal[3:])
-			}
-		} else if val.Type == "A" {
-			if row.Cells[i].String() == "" {
-				continue
-			}
-			idx, err := strconv.Atoi(val.ExVal[2])
-			util.IfErrPanic(err)
-			v.Reserve(idx)
+}
 
-			v.AVal[idx].NVal, v.AVal[idx].Type = RealValue(row.Cells[i], val.ExVal, 3)
-		} else if val.Type == "AT" {
-			if row.Cells[i].String() == "" {
-				continue
-			}
-			idx, err := strconv.Atoi(val.ExVal[2])
-			util.IfErrPanic(err)
-			v.Reserve(idx)
-			v.AVal[idx].Type = "T"
-			cstr, ctype := RealValue(row.Cells[i], val.ExVal, 4)
-			v.AVal[idx].TVal[val.ExVal[3]] = &ToLuaValue{Type: ctype, NVal: cstr}
-		} else if val.Type == "T" {
-			if row.Cells[i].String() == "" {
-				continue
-			}
-			cstr, ctype := RealValue(row.Cells[i], val.ExVal, 3)
-			v.TVal[val.ExVal[2]] = &ToLuaValue{Type: ctype, NVal: cstr}
-		} else if val.Type == "TA" {
-			if row.Cells[i].String() == "" {
-				continue
-			}
-			tval, ok := v.TVal[val.ExVal[2]]
-			if !ok {
-				tval = &ToLuaValue{Type: "A"}
-				v.TVal[val.ExVal[2]] = tval
-			}
-			idx, err := strconv.Atoi(val.ExVal[3])
-			util.IfErrPanic(err)
-			tval.Reserve(idx)
-			tval.AVal[idx].NVal, tval.AVal[idx].Type = RealValue(row.Cells[i], val.ExVal, 4)
-		} else if val.Type == "ATA" {
-			if row.Cells[i].String() == "" {
+// RealValue guesses the type of a cell in an array or table column.
+func RealValue(cell string) interface{} {
+	if n, err := parseNumber(cell); err == nil {
+		return n
+	}
+	if cell == "true" || cell == "false" {
+		return cell == "true"
+	}
+	return cell
+}
+
+func (c *column) Value(cell string) (interface{}, error) {
+	if cellTypes[c.Type] {
+		return cellValue(c.Type, cell, c.Enum())
+	}
+	if enum := c.Enum(); enum != "" {
+		v, err := enumValue(enum, cell)
+		if err != nil {
+			return nil, err
+		}
+		cell = v
+	}
+
+	switch c.Type {
+	case "N":
+		n, err := parseNumber(cell)
+		if err != nil {
+			return nil, errors.New("invalid number " + strconv.Quote(cell))
+		}
+		return n, nil
+	case "B":
+		b, err := strconv.ParseBool(cell)
+		if err != nil {
+			return nil, errors.New("invalid bool " + strconv.Quote(cell))
+		}
+		return b, nil
+	case "S":
+		return cell, nil
+	case "L":
+		return LuaCode(cell), nil
+	case "DATE":
+		return dateValue(cell)
+	case "DUR":
+		return durationValue(cell)
+	case "A", "AT", "T", "TA", "ATA":
+		return RealValue(cell), nil
+	default:
+		panic("invalid type")
+	}
+}
+
+func (t *TableConfig) ParseRow(row []string, includekey bool) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	for name, cols := range t.cols {
+		if !includekey && name == t.key.Name || !included(cols) {
+			continue
+		}
+
+		var value interface{}
+		for _, c := range cols {
+			if c.Index >= len(row) || row[c.Index] == "" || !sideIncluded(c.Side) {
 				continue
 			}
-			idx, err := strconv.Atoi(val.ExVal[2])
-			util.IfErrPanic(err)
-			v.Reserve(idx)
-			v.AVal[idx].Type = "T"
-
-			tval, ok := v.AVal[idx].TVal[val.ExVal[3]]
-			if !ok {
-				tval = &ToLuaValue{Type: "T"}
-				v.TVal[val.ExVal[3]] = tval
-			}
 
-			idx, err = strconv.Atoi(val.ExVal[4])
-			util.IfErrPanic(err)
-			tval.Reserve(idx)
-			tval.AVal[idx].NVal, tval.AVal[idx].Type = RealValue(row.Cells[i], val.ExVal, 5)
+			v, err := c.Value(row[c.Index])
+			if err != nil {
+				return nil, errors.New("column " + strconv.Itoa(c.Index+1) + " " + name + ": " + err.Error())
+			}
+			value = setPath(value, c.Path, v)
 		}
 
-		v.Type = val.Type
+		if value != nil {
+			result[name] = value
+		} else if v, ok := t.emptyValue(cols[0]); ok {
+			result[name] = v
+		}
 	}
 
-	return result
+	return result, nil
 }
 
+// Parse converts a sheet whose first row declares the columns, a table with
+// a key column becomes a map from key to row, otherwise an array of rows.
 func (t *TableConfig) Parse(data [][]string) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty sheet")
+	}
 	if err := t.init(data[0]); err != nil {
 		return nil, err
 	}
 
-	var result interface{}
-	if t.key.Type == "N" {
-		result = make([]interface{}, len(data)-1)
-	} else {
-		result = make(map[string]interface{})
+	if t.key.Index == -1 {
+		result := make([]interface{}, 0, len(data)-1)
+		for i := t.firstRow(); i < len(data); i++ {
+			if isBlank(data[i]) || !t.rowIncluded(data[i]) {
+				continue
+			}
+			row, err := t.ParseRow(data[i], true)
+			if err != nil {
+				return nil, fmt.Errorf("row %d %v", i+1, err)
+			}
+			result = append(result, row)
+		}
+		return result, nil
 	}
 
-	for i := 1; i < len(data); i++ {
+	result := make(map[string]interface{})
+	for i := t.firstRow(); i < len(data); i++ {
+		if t.key.Index >= len(data[i]) || isBlank(data[i]) || !t.rowIncluded(data[i]) {
+			continue
+		}
+		row, err := t.ParseRow(data[i], false)
+		if err != nil {
+			return nil, fmt.Errorf("row %d %v", i+1, err)
+		}
+		key := data[i][t.key.Index]
 		if t.key.Type == "N" {
-			row := t.ParseRow(data[i], true)
-			result = append(result.([]interface{}), row)
-		} else {
-			result.(map[string]interface{})[data[0][t.key.Index]] = t.ParseRow(data[i], false)
+			key = refValue(key)
 		}
+		result[key] = row
 	}
 
-	return nil, nil
+	if t.key.Type == "S" {
+		return StringKeyed(result), nil
+	}
+	return result, nil
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"log"
+	"sort"
 
 	"github.com/tealeg/xlsx"
 )
@@ -9,6 +12,7 @@ import (
 type XlsxHelper struct {
 	file *xlsx.File
 	name string
+	eval *formulaEval
 }
 
 var _sheet string = ""
@@ -17,6 +21,59 @@ func SetSheetName(s string) {
 	_sheet = s
 }
 
+var _fillMerged bool = false
+var _skipHidden []string = nil
+
+// SetXlsxOptions sets whether the cells of a merged range all read the value
+// of its top-left cell, and which of the hidden rows, cols and sheets are
+// skipped. Hidden rows before the data, like a hidden type row, are always
+// read.
+func SetXlsxOptions(fillMerged bool, skipHidden []string) error {
+	for _, what := range skipHidden {
+		if what != "rows" && what != "cols" && what != "sheets" {
+			return errors.New("unknown hidden " + what + ", expect rows, cols or sheets")
+		}
+	}
+	_fillMerged = fillMerged
+	_skipHidden = append([]string{}, skipHidden...)
+	sort.Strings(_skipHidden)
+	return nil
+}
+
+// xlsxFlags adds the flags of merged, hidden and formula cells to fs, the
+// returned function sets them once fs is parsed.
+func xlsxFlags(fs *flag.FlagSet) func() error {
+	fillMerged := fs.Bool("fillmerged", false, "-fillmerged every cell of a merged range of xlsx reads the value of its top-left cell")
+	skipHidden := fs.String("skiphidden", "", "-skiphidden comma separated hidden rows, cols and sheets of xlsx to skip")
+	formula := fs.String("formula", "cached", "-formula read the cached values of xlsx formulas, or eval the simple ones")
+	return func() error {
+		if err := SetXlsxOptions(*fillMerged, splitList(*skipHidden)); err != nil {
+			return err
+		}
+		return SetFormulaPolicy(*formula)
+	}
+}
+
+func skipsHidden(what string) bool {
+	for _, w := range _skipHidden {
+		if w == what {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenSheet reports whether h is an xlsx input whose sheet is hidden and
+// skipped.
+func hiddenSheet(h Helper) bool {
+	x, ok := h.(*XlsxHelper)
+	if !ok || !skipsHidden("sheets") {
+		return false
+	}
+	s, ok := x.file.Sheet[_sheet]
+	return ok && s.Hidden
+}
+
 func NewXlsxHelper(name string) (Helper, error) {
 	x := &XlsxHelper{name: name}
 
@@ -29,26 +86,29 @@ func NewXlsxHelper(name string) (Helper, error) {
 }
 
 func (x *XlsxHelper) ReadMap(key string) (interface{}, error) {
-	if s, ok := x.file.Sheet[_sheet]; ok {
+	if _, ok := x.file.Sheet[_sheet]; ok {
 		header, err := x.HeaderIndex()
 		if err != nil {
 			return nil, err
 		}
 
 		if kindex, exist := header[key]; exist {
+			data, _ := readSheet(x)
+			data = untypedSide(data)
+			if v := checkKeys(data, dataRow(), kindex, key, ""); len(v) > 0 {
+				return nil, violationsError(v)
+			}
+
 			result := make(map[string]map[string]interface{})
-			for i := 1; i < len(s.Rows); i++ {
-				if kindex >= len(s.Rows[i].Cells) {
+			for i := dataRow(); i < len(data); i++ {
+				if kindex >= len(data[i]) || isBlank(data[i]) {
 					continue
 				}
-				kval := s.Rows[i].Cells[kindex].String()
-				result[kval] = make(map[string]interface{})
-
-				for j := 0; j < len(s.Rows[i].Cells); j++ {
-					if j != kindex {
-						result[kval][s.Rows[0].Cells[j].String()] = s.Rows[i].Cells[j].String()
-					}
+				row, err := rowMap(data[0], data[i], i, kindex)
+				if err != nil {
+					return nil, err
 				}
+				result[data[i][kindex]] = row
 			}
 			return result, nil
 		} else {
@@ -69,19 +129,92 @@ func (x *XlsxHelper) WriteMapString(values map[string]map[string]interface{}) er
 
 func (x *XlsxHelper) ReadArray() ([][]string, error) {
 	if s, ok := x.file.Sheet[_sheet]; ok {
+		if s.Hidden && skipsHidden("sheets") {
+			return nil, errors.New("sheet: " + _sheet + " is hidden")
+		}
 		var result [][]string = make([][]string, len(s.Rows))
 		for i := 0; i < len(s.Rows); i++ {
 			result[i] = make([]string, len(s.Rows[i].Cells))
 			for j := 0; j < len(s.Rows[i].Cells); j++ {
-				result[i][j] = s.Rows[i].Cells[j].String()
+				result[i][j] = x.cellText(s, s.Rows[i].Cells[j], i, j)
 			}
 		}
+		x.mergeCells(s, result)
+		x.hideCells(s, result)
 		return result, nil
 	} else {
 		return nil, errors.New("sheet: " + _sheet + " not exists")
 	}
 }
 
+// mergeCells fills the merged ranges of s in data with the value of their
+// top-left cell when enabled, and warns about ranges spanning several data
+// rows, which read as one value followed by blanks otherwise.
+func (x *XlsxHelper) mergeCells(s *xlsx.Sheet, data [][]string) {
+	for i, row := range s.Rows {
+		for j, c := range row.Cells {
+			if c.HMerge == 0 && c.VMerge == 0 {
+				continue
+			}
+			if c.VMerge > 0 && i+c.VMerge >= dataRow() {
+				log.Println(x.name, _sheet, "merged cells", cellName(i, j)+":"+cellName(i+c.VMerge, j+c.HMerge), "span data rows")
+			}
+			if !_fillMerged {
+				continue
+			}
+			for r := i; r <= i+c.VMerge && r < len(data); r++ {
+				for len(data[r]) <= j+c.HMerge {
+					data[r] = append(data[r], "")
+				}
+				for k := j; k <= j+c.HMerge; k++ {
+					data[r][k] = data[i][j]
+				}
+			}
+		}
+	}
+}
+
+// hideCells empties the hidden data rows and hidden columns of s in data
+// as far as they are skipped, so that the other cells keep their names.
+func (x *XlsxHelper) hideCells(s *xlsx.Sheet, data [][]string) {
+	if skipsHidden("rows") {
+		for i := dataRow(); i < len(s.Rows) && i < len(data); i++ {
+			if s.Rows[i].Hidden {
+				data[i] = nil
+			}
+		}
+	}
+	if skipsHidden("cols") {
+		for _, col := range s.Cols {
+			if col == nil || !col.Hidden {
+				continue
+			}
+			for _, row := range data {
+				for k := col.Min - 1; k < col.Max && k < len(row); k++ {
+					row[k] = ""
+				}
+			}
+		}
+	}
+}
+
+// cellText returns the text of the cell at row i and column j of s, dates
+// and times whatever their style as excelCellText does, formulas as
+// formulaValue does.
+func (x *XlsxHelper) cellText(s *xlsx.Sheet, c *xlsx.Cell, i, j int) string {
+	value, evaluated := c.Value, false
+	if formula := c.Formula(); formula != "" {
+		value, evaluated = x.formulaValue(s, c, i, j, formula)
+	}
+	if text, ok := excelCellText(value, c.NumFmt, x.file.Date1904); ok {
+		return text
+	}
+	if evaluated {
+		return value
+	}
+	return c.String()
+}
+
 func (x *XlsxHelper) WriteArray(values [][]string) error {
 	s, ok := x.file.Sheet[_sheet]
 	if !ok {
@@ -108,10 +241,13 @@ func (x *XlsxHelper) WriteArray(values [][]string) error {
 }
 
 func (x *XlsxHelper) HeaderIndex() (map[string]int, error) {
-	if s, ok := x.file.Sheet[_sheet]; ok {
+	if data, err := readSheet(x); err == nil && len(data) > 0 {
+		data = untypedSide(data)
 		var header map[string]int = map[string]int{}
-		for i := 0; i < len(s.Rows[0].Cells); i++ {
-			h := s.Rows[0].Cells[i].String()
+		for i, h := range data[0] {
+			if h == "" {
+				continue
+			}
 			if _, exist := header[h]; exist {
 				return nil, errors.New("sheet: " + _sheet + " has duplicate header " + h)
 			}